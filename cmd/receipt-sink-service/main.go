@@ -8,7 +8,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ONSdigital/sdx-evolution/internal/notification"
 	"github.com/ONSdigital/sdx-evolution/internal/rabbit"
+	redis "github.com/ONSdigital/sdx-evolution/internal/redis"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
 	"github.com/gorilla/mux"
 	"github.com/streadway/amqp"
 )
@@ -16,6 +19,7 @@ import (
 var (
 	rabbitConn     *amqp.Connection
 	notifyExchange string
+	stages         *tracker.Tracker
 )
 
 func main() {
@@ -38,18 +42,37 @@ func main() {
 		log.Fatal(`event="Failed to start - NOTIFICATION_EXCHANGE must be specified"`)
 	}
 
+	var redisURI string
+	if redisURI = os.Getenv("REDIS_URL"); len(redisURI) == 0 {
+		log.Fatal(`event="Failed to start - Must supply REDIS_URL environment variable"`)
+	}
+
+	// Pipeline tracking - shared with the other services via redis
+	redisPool := redis.NewPool(redisURI, 2)
+	defer redisPool.Close()
+	stages = tracker.New(redisPool, "receipt-sink-service")
+
 	// Set up the connection to the RabbitMQ server
 	rabbitConn = rabbit.ConnectWithRetry(rabbitURI, time.Second*2)
 	defer rabbitConn.Close()
 
 	// Define the worker function that will process messages received from
 	// the queue
-	worker := func(b []byte) {
-		log.Printf(`event="Would be receipting" tx_id="%s"`, b)
+	worker := func(d amqp.Delivery) {
+		n, err := notification.FromDelivery(d)
+		if err != nil {
+			log.Printf(`event="Failed to decode notification" error="%v"`, err)
+			return
+		}
+		log.Printf(`event="Would be receipting" tx_id="%s" survey_id="%s" source="%s"`, n.TxID, n.SurveyID, n.Source)
+
+		// Standing in for the receipting service, so the receipted stage is
+		// recorded once the notification has been handled
+		stages.Record(n.TxID, tracker.Receipted, "")
 	}
 
 	// Start up the worker to consume from the queue
-	cancel, err := rabbit.StartSimpleTopicConsumer(notifyExchange, "survey.#", "test_survey_receipt", rabbitConn, worker)
+	cancel, err := rabbit.StartTopicConsumer(notifyExchange, "survey.#", "test_survey_receipt", rabbitConn, worker)
 	if err != nil {
 		log.Fatalf(`event="Failed to start consumer" error="%v"`, err)
 	}
@@ -8,7 +8,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ONSdigital/sdx-evolution/internal/notification"
 	"github.com/ONSdigital/sdx-evolution/internal/rabbit"
+	redis "github.com/ONSdigital/sdx-evolution/internal/redis"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
 	"github.com/gorilla/mux"
 	"github.com/streadway/amqp"
 )
@@ -16,6 +19,7 @@ import (
 var (
 	downstreamExchange string
 	rabbitConn         *amqp.Connection
+	stages             *tracker.Tracker
 )
 
 const (
@@ -40,10 +44,20 @@ func main() {
 		log.Fatal(`event="Failed to start - DOWNSTREAM_EXCHANGE must be specified"`)
 	}
 
+	var redisURI string
+	if redisURI = os.Getenv("REDIS_URL"); len(redisURI) == 0 {
+		log.Fatal(`event="Failed to start - Must supply REDIS_URL environment variable"`)
+	}
+
+	// Pipeline tracking - shared with the other services via redis
+	redisPool := redis.NewPool(redisURI, 2)
+	defer redisPool.Close()
+	stages = tracker.New(redisPool, "sdx-commonsoftware-service")
+
 	rabbitConn = rabbit.ConnectWithRetry(rabbitURI, time.Second*2)
 	defer rabbitConn.Close()
 
-	cancel, err := rabbit.StartSimpleTopicConsumer(
+	cancel, err := rabbit.StartTopicConsumer(
 		downstreamExchange,
 		topic,
 		"sdx.survey.downstream.cs.work",
@@ -63,6 +77,12 @@ func main() {
 	log.Print(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 }
 
-func worker(b []byte) {
-	log.Printf(`event="Would be downstreaming (CS)" tx_id="%s"`, b)
+func worker(d amqp.Delivery) {
+	n, err := notification.FromDelivery(d)
+	if err != nil {
+		log.Printf(`event="Failed to decode notification" error="%v"`, err)
+		return
+	}
+	log.Printf(`event="Would be downstreaming (CS)" tx_id="%s" survey_id="%s" instrument_id="%s" period="%s"`, n.TxID, n.SurveyID, n.InstrumentID, n.Period)
+	stages.Record(n.TxID, tracker.Delivered, "commonsoftware")
 }
@@ -14,7 +14,7 @@ func Load() {
 
 	// We know how many items we're going to have in the map
 	// so we can pre-declare the length as a compiler hint.
-	C = make(map[string]string, 5)
+	C = make(map[string]string, 6)
 
 	required := []string{
 		"PORT",
@@ -29,4 +29,15 @@ func Load() {
 			log.Fatalf(`event="Failed to start - Must supply %s environment variable"`, r)
 		}
 	}
+
+	// Optional variables and their defaults
+	optional := map[string]string{
+		"CLOUDEVENTS_MODE": "none",
+	}
+
+	for o, def := range optional {
+		if C[o] = os.Getenv(o); len(C[o]) == 0 {
+			C[o] = def
+		}
+	}
 }
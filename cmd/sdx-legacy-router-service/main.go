@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,9 +12,12 @@ import (
 	"time"
 
 	"github.com/ONSdigital/sdx-evolution/cmd/sdx-legacy-router-service/config"
+	"github.com/ONSdigital/sdx-evolution/internal/cloudevents"
+	"github.com/ONSdigital/sdx-evolution/internal/notification"
 	"github.com/ONSdigital/sdx-evolution/internal/rabbit"
 	redis "github.com/ONSdigital/sdx-evolution/internal/redis"
 	"github.com/ONSdigital/sdx-evolution/internal/signals"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
 
 	"github.com/gorilla/mux"
 	"github.com/streadway/amqp"
@@ -22,8 +26,25 @@ import (
 var (
 	rabbitConn *amqp.Connection
 	redisConn  redis.Conn
+	stages     *tracker.Tracker
+
+	// eventMode is how downstream messages are published as CloudEvents.
+	// Empty means the notification is passed on as it was received.
+	eventMode cloudevents.Mode
+
+	// requeueBackoff is how long to wait before requeuing a message we
+	// couldn't publish on, so that a broker problem doesn't become a tight
+	// redelivery loop
+	requeueBackoff = time.Second * 2
 )
 
+// confirmingPublisher is what routing needs of a rabbit.ConfirmingPublisher
+type confirmingPublisher interface {
+	Publish(exchange, key string, msg amqp.Publishing) error
+	IsClosed() bool
+	Close() error
+}
+
 // Various constants
 const (
 	// Delay is the amount of time (milliseconds) to delay a message
@@ -33,6 +54,14 @@ const (
 	delay = int16(5000)
 
 	RedisURL = "redis://redis:6379"
+
+	// publishConfirmTimeout is how long to wait for the broker to confirm a
+	// message we've routed before giving up and requeuing the original
+	publishConfirmTimeout = time.Second * 5
+
+	// eventSource is the CloudEvents source of the downstream messages we
+	// publish
+	eventSource = "/sdx/legacy-router"
 )
 
 // Queues and topics
@@ -71,11 +100,23 @@ func main() {
 	redisConn = redis.ConnectWithRetry(RedisURL, time.Second*2)
 	defer redisConn.Close()
 
+	// Pipeline tracking needs its own pooled connections as it's used from
+	// the consumer goroutine
+	redisPool := redis.NewPool(RedisURL, 2)
+	defer redisPool.Close()
+	stages = tracker.New(redisPool, "sdx-legacy-router-service")
+
 	if err := populateInitialSurveyConfig(); err != nil {
 		log.Printf(`event="Redis error" error="%s"`, err)
 	}
 
 	// RabbitMQ
+	if config.C["CLOUDEVENTS_MODE"] != "none" {
+		var err error
+		if eventMode, err = cloudevents.ParseMode(config.C["CLOUDEVENTS_MODE"]); err != nil {
+			log.Fatalf(`event="Failed to start - invalid CLOUDEVENTS_MODE" error="%v"`, err)
+		}
+	}
 	rabbitConn = rabbit.ConnectWithRetry(config.C["RABBIT_URL"], time.Second*2)
 	defer rabbitConn.Close()
 
@@ -186,6 +227,15 @@ func startQueues(conn *amqp.Connection) (func(), error) {
 		return nil, err
 	}
 
+	// Everything published from here on is confirmed by the broker before
+	// we ack (or nack) the message we received
+	out, err := rabbit.NewConfirmingPublisher(chOut, publishConfirmTimeout)
+	if err != nil {
+		log.Printf(`event="Failed to create publisher" error="%v"`, err)
+		return nil, err
+	}
+	var publisher confirmingPublisher = out
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func(ctx context.Context) {
@@ -193,9 +243,17 @@ func startQueues(conn *amqp.Connection) (func(), error) {
 			select {
 			case <-ctx.Done():
 				log.Print(`event="Canceling consumer"`)
-				chOut.Close()
+				publisher.Close()
 			default:
-				log.Printf(`event="Legacy router received message" data="%s"`, d.Body)
+				n, err := notification.FromDelivery(d)
+				if err != nil {
+					// It will never be readable so there's no point
+					// requeuing it
+					log.Printf(`event="Failed to decode notification - discarding" message_id="%s" error="%v"`, d.MessageId, err)
+					_ = d.Nack(false, false)
+					continue
+				}
+				log.Printf(`event="Legacy router received notification" tx_id="%s" survey_id="%s" instrument_id="%s"`, n.TxID, n.SurveyID, n.InstrumentID)
 
 				// Determine whether we want to process this message
 				// (for now, ack and discard)
@@ -206,8 +264,12 @@ func startQueues(conn *amqp.Connection) (func(), error) {
 				}
 				log.Println(surveyConfig.Surveys)
 
-				// Assuming routing key is survey.notify.<source>.<type>
-				surveyID := strings.Split(d.RoutingKey, ".")[3]
+				surveyID := n.SurveyID
+				if len(surveyID) == 0 {
+					// A notification from before the survey_id was in the
+					// body - routing key is survey.notify.<source>.<type>
+					surveyID = strings.Split(d.RoutingKey, ".")[3]
+				}
 				surveyIsActive := false
 
 				// TODO This is assuming the survey config for this survey
@@ -226,52 +288,37 @@ func startQueues(conn *amqp.Connection) (func(), error) {
 
 					log.Print(`event="Survey is active - processing"`)
 
-					if err = chOut.Publish(
+					msg, err := downstreamMessage(d, n)
+					if err != nil {
+						log.Printf(`event="Failed to encode downstream message - discarding" tx_id="%s" error="%v"`, n.TxID, err)
+						_ = d.Nack(false, false)
+						continue
+					}
+					err = publisher.Publish(
 						config.C["DOWNSTREAM_EXCHANGE"],
 						downstreamRoutingKey,
-						false,
-						false,
-						amqp.Publishing{
-							ContentType: "text/plain",
-							Body:        d.Body,
-						}); err != nil {
-
-						// TODO How to properly handle error here
-						log.Fatalf(`event="Failed to publish to downstream queue" error="%v"`, err)
+						msg)
+					if err == nil {
+						stages.Record(n.TxID, tracker.Routed, thisSurvey.Downstream)
+						_ = d.Ack(false)
+						continue
 					}
 
-					_ = d.Ack(false)
-					continue
-				}
-
-				log.Print(`event="Survey is INACTIVE - re-queuing"`)
+					if !errors.Is(err, rabbit.ErrReturned) {
+						// Leave the message with the broker to try again
+						log.Printf(`event="Failed to publish to downstream queue - requeuing" error="%v"`, err)
+						publisher = requeue(d, publisher, err)
+						continue
+					}
 
-				// Remove the message from the original queue - amqp prefers
-				// a nack() with no requeue over a reject()
-				if err = d.Nack(false, false); err != nil {
-					// TODO How to handle better
-					log.Fatalf(`event="Failed to nack"`)
+					// Nothing is bound to receive this downstream yet so treat
+					// it the same as an inactive survey
+					log.Printf(`event="No queue bound for downstream - delaying" downstream="%s"`, thisSurvey.Downstream)
+				} else {
+					log.Print(`event="Survey is INACTIVE - re-queuing"`)
 				}
 
-				if err = chOut.Publish(
-					legacyDelayExchange,
-					d.RoutingKey,
-					false,
-					false,
-					amqp.Publishing{
-						ContentType: "text/plain",
-						Body:        d.Body,
-						Headers: amqp.Table{
-							// Re-publish with the original routing key so that
-							// it'll correctly re-route when TTL'd back to the
-							// exchange
-							"x-dead-letter-routing-key": d.RoutingKey,
-						},
-					}); err != nil {
-
-					// TODO How to properly handle error here
-					log.Fatalf(`event="Failed to publish to delay queue" error="%v"`, err)
-				}
+				publisher = delaySurvey(d, n, legacyDelayExchange, publisher)
 			}
 		}
 	}(ctx)
@@ -279,3 +326,122 @@ func startQueues(conn *amqp.Connection) (func(), error) {
 
 	return cancel, nil
 }
+
+// delaySurvey puts a message on the delay queue, from which it comes back
+// round once its TTL expires, then removes it from the work queue. A message
+// that can't be delayed is requeued as for a failed downstream publish. It
+// returns the publisher to carry on with.
+func delaySurvey(d amqp.Delivery, n *notification.Notification, exchange string, publisher confirmingPublisher) confirmingPublisher {
+	if err := publisher.Publish(
+		exchange,
+		d.RoutingKey,
+		forward(d, amqp.Table{
+			// Re-publish with the original routing key so that
+			// it'll correctly re-route when TTL'd back to the
+			// exchange
+			"x-dead-letter-routing-key": d.RoutingKey,
+		})); err != nil {
+
+		log.Printf(`event="Failed to publish to delay queue - requeuing" error="%v"`, err)
+		return requeue(d, publisher, err)
+	}
+
+	stages.Record(n.TxID, tracker.Delayed, "")
+
+	// Only now the delay queue has it can we remove the message
+	// from the original queue - amqp prefers a nack() with no
+	// requeue over a reject()
+	if err := d.Nack(false, false); err != nil {
+		// TODO How to handle better
+		log.Fatalf(`event="Failed to nack"`)
+	}
+	return publisher
+}
+
+// requeue hands a message we failed to publish on back to the broker after a
+// backoff. If the publish failed because the publishing channel has closed,
+// it returns a publisher on a new channel to carry on with.
+func requeue(d amqp.Delivery, publisher confirmingPublisher, err error) confirmingPublisher {
+	time.Sleep(requeueBackoff)
+	_ = d.Nack(false, true)
+
+	if errors.Is(err, rabbit.ErrPublisherClosed) || publisher.IsClosed() {
+		return reopenPublisher(publisher)
+	}
+	return publisher
+}
+
+// reopenPublisher replaces a publisher whose channel has closed. If a new
+// channel can't be opened the connection has most likely gone too, so we exit
+// and let the restart bring everything back up.
+func reopenPublisher(old confirmingPublisher) *rabbit.ConfirmingPublisher {
+	log.Print(`event="Publishing channel closed - reopening"`)
+	old.Close()
+
+	ch, err := rabbitConn.Channel()
+	if err != nil {
+		log.Fatalf(`event="Failed to reopen outgoing channel" error="%v"`, err)
+	}
+
+	// The channel was most likely closed by an error caused by an exchange
+	// having gone away, so make sure they're there
+	if err = rabbit.DeclareExchangeWithDefaults(config.C["DOWNSTREAM_EXCHANGE"], ch); err != nil {
+		log.Fatalf(`event="Failed to declare exchange" exchange="%s" error="%v"`, config.C["DOWNSTREAM_EXCHANGE"], err)
+	}
+	if _, err = rabbit.DeclareDeadLetterExchangeWithDefaults(config.C["LEGACY_EXCHANGE"], ch); err != nil {
+		log.Fatalf(`event="Failed to declare dead letter exchange" error="%v"`, err)
+	}
+
+	publisher, err := rabbit.NewConfirmingPublisher(ch, publishConfirmTimeout)
+	if err != nil {
+		log.Fatalf(`event="Failed to create publisher" error="%v"`, err)
+	}
+	return publisher
+}
+
+// downstreamMessage builds the message to send a notification downstream
+// with - a CloudEvent of its own if configured, otherwise the notification as
+// received
+func downstreamMessage(d amqp.Delivery, n *notification.Notification) (amqp.Publishing, error) {
+	if len(eventMode) == 0 {
+		return forward(d, nil), nil
+	}
+	if n.Version == 0 {
+		// A bare tx_id from before the notification format - there's
+		// nothing to build an event from, so pass it on as it is
+		return forward(d, nil), nil
+	}
+	return n.CloudEvent(eventMode, downstreamEventID(n), eventSource, notification.DownstreamEventType)
+}
+
+// downstreamEventID gives the downstream event an id of its own, rather than
+// reusing the notify event's. It's made from the tx_id so that a notification
+// delivered again gives the same event, which consumers can drop as a
+// duplicate - the subject, the tx_id, links it to the notify event.
+func downstreamEventID(n *notification.Notification) string {
+	return n.TxID + ".downstream"
+}
+
+// forward builds the message to pass a notification on with, keeping the
+// body, identifying properties and CloudEvents attributes of the one we
+// received. Broker added headers (x-death etc) are dropped.
+func forward(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	table := amqp.Table{}
+	for k, v := range d.Headers {
+		if !strings.HasPrefix(k, "x-") {
+			table[k] = v
+		}
+	}
+	for k, v := range headers {
+		table[k] = v
+	}
+	return amqp.Publishing{
+		ContentType:   d.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     d.MessageId,
+		CorrelationId: d.CorrelationId,
+		Timestamp:     d.Timestamp,
+		Headers:       table,
+		Body:          d.Body,
+	}
+}
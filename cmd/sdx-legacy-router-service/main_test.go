@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/internal/cloudevents"
+	"github.com/ONSdigital/sdx-evolution/internal/notification"
+	"github.com/ONSdigital/sdx-evolution/internal/rabbit"
+
+	"github.com/streadway/amqp"
+)
+
+// fakePublisher fails every publish with err, recording what it was given
+type fakePublisher struct {
+	err       error
+	published []amqp.Publishing
+}
+
+func (p *fakePublisher) Publish(exchange, key string, msg amqp.Publishing) error {
+	p.published = append(p.published, msg)
+	return p.err
+}
+func (p *fakePublisher) IsClosed() bool { return false }
+func (p *fakePublisher) Close() error   { return nil }
+
+// fakeAcknowledger records how a delivery was settled
+type fakeAcknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error { a.acked = true; return nil }
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error { return a.Nack(tag, false, requeue) }
+
+func TestDownstreamMessage(t *testing.T) {
+	n := notification.Notification{TxID: "abc", Source: "eq", SurveyID: "023", InstrumentID: "0203"}
+	notify, err := n.CloudEvent(cloudevents.Binary, n.TxID, "/sdx/survey-gateway", notification.NotifyEventType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := amqp.Delivery{ContentType: notify.ContentType, Headers: notify.Headers, MessageId: notify.MessageId, Body: notify.Body}
+	received, err := notification.FromDelivery(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Passed on unchanged by default
+	eventMode = ""
+	msg, err := downstreamMessage(d, received)
+	if err != nil || msg.MessageId != n.TxID || string(msg.Body) != string(notify.Body) {
+		t.Errorf("Expected the notification to be passed on unchanged, got %+v (%v)", msg, err)
+	}
+
+	// Its own event, linked to the notify event by the tx_id
+	eventMode = cloudevents.Binary
+	defer func() { eventMode = "" }()
+	msg, err = downstreamMessage(d, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := cloudevents.FromDelivery(amqp.Delivery{ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID == n.TxID || e.Type != notification.DownstreamEventType {
+		t.Errorf("Expected a downstream event with an id of its own, got %+v", e)
+	}
+	if e.Subject != n.TxID || msg.CorrelationId != n.TxID {
+		t.Errorf("Expected the downstream event to have the tx_id as its subject and correlation id, got %+v", e)
+	}
+	if again, _ := downstreamMessage(d, received); again.MessageId != msg.MessageId {
+		t.Errorf("Expected the same id for the same notification, got %s and %s", msg.MessageId, again.MessageId)
+	}
+
+	// A message that can't be delayed is requeued after a backoff, not nacked
+	// straight back into a tight redelivery loop
+	backoff := requeueBackoff
+	requeueBackoff = 0
+	defer func() { requeueBackoff = backoff }()
+	for _, err := range []error{nil, rabbit.ErrReturned} {
+		ack := &fakeAcknowledger{}
+		d.Acknowledger, d.RoutingKey = ack, "survey.notify.eq.023.0203"
+		publisher := &fakePublisher{err: err}
+		if next := delaySurvey(d, received, "sdx.legacy.delay", publisher); next != publisher {
+			t.Errorf("Expected to carry on with the same publisher, got %v", next)
+		}
+		if len(publisher.published) != 1 || publisher.published[0].Headers["x-dead-letter-routing-key"] != d.RoutingKey {
+			t.Errorf("Expected the message to be published to be delayed, got %+v", publisher.published)
+		}
+		if !ack.nacked || ack.acked || ack.requeued != (err != nil) {
+			t.Errorf("Expected requeue=%v once the delay publish returns %v, got %+v", err != nil, err, ack)
+		}
+	}
+}
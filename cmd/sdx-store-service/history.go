@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+
+	"github.com/gorilla/mux"
+)
+
+// history is the response to a request for a submission's history
+type history struct {
+	TxID         string     `json:"tx_id"`
+	RuRef        string     `json:"ru_ref,omitempty"`
+	SurveyID     string     `json:"survey_id,omitempty"`
+	InstrumentID string     `json:"instrument_id,omitempty"`
+	Period       string     `json:"period,omitempty"`
+	Revisions    []revision `json:"revisions"`
+}
+
+// revision is one revision in a submission's history
+type revision struct {
+	Revision   int       `json:"revision"`
+	TxID       string    `json:"tx_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Size       int       `json:"size"`
+
+	// What changed from the previous revision, if asked for
+	Changes []change `json:"changes,omitempty"`
+}
+
+// change is a single difference between two JSON documents
+type change struct {
+	Op   string      `json:"op"`   // add, remove or replace
+	Path string      `json:"path"` // JSON pointer (RFC6901) to what changed
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// SurveyHistoryHandler responds with every revision of the submission a
+// tx_id belongs to - that is, everything submitted for the same ru_ref,
+// survey, instrument and period. With diff=true each revision lists what
+// changed from the one before.
+func SurveyHistoryHandler(rw http.ResponseWriter, r *http.Request) {
+	txID := mux.Vars(r)["tx_id"]
+
+	revisions, err := storage.History(store, txID)
+	if err == storage.ErrNotFound {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Survey not found",
+			Status: http.StatusNotFound,
+			Detail: "No survey is stored with this tx_id",
+		}, rw)
+		return
+	}
+	if err != nil {
+		log.Printf(`event="Failed to get survey history" tx_id="%s" error="%v"`, txID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to get survey history",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	first := revisions[0]
+	h := history{
+		TxID:         txID,
+		RuRef:        first.RuRef,
+		SurveyID:     first.SurveyID,
+		InstrumentID: first.InstrumentID,
+		Period:       first.Period,
+		Revisions:    make([]revision, 0, len(revisions)),
+	}
+	for _, m := range revisions {
+		h.Revisions = append(h.Revisions, revision{Revision: m.Revision, TxID: m.TxID, ReceivedAt: m.ReceivedAt, Size: m.Size})
+	}
+
+	if diff, _ := strconv.ParseBool(r.URL.Query().Get("diff")); diff {
+		if err = diffRevisions(h.Revisions); err != nil {
+			log.Printf(`event="Failed to diff survey revisions" tx_id="%s" error="%v"`, txID, err)
+			api.WriteProblemResponse(api.Problem{
+				Title:  "Unable to get survey history",
+				Status: http.StatusInternalServerError,
+			}, rw)
+			return
+		}
+	}
+
+	body, err := json.Marshal(&h)
+	if err != nil {
+		log.Printf(`event="Failed to marshal survey history" tx_id="%s" error="%v"`, txID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to get survey history",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// diffRevisions fills in the changes of each revision from the one before.
+// A revision that isn't JSON is compared as a whole.
+func diffRevisions(revisions []revision) error {
+	var previous interface{}
+	for i := range revisions {
+		record, err := store.Get(revisions[i].TxID)
+		if err != nil {
+			return err
+		}
+		var doc interface{}
+		if err = json.Unmarshal(record.Data, &doc); err != nil {
+			doc = string(record.Data)
+		}
+		if i > 0 {
+			revisions[i].Changes = diffJSON("", previous, doc, nil)
+		}
+		previous = doc
+	}
+	return nil
+}
+
+// diffJSON appends the changes that turn one decoded JSON value into
+// another. Objects are compared by member and arrays by index.
+func diffJSON(path string, from, to interface{}, changes []change) []change {
+	switch f := from.(type) {
+	case map[string]interface{}:
+		t, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(f)+len(t))
+		for k := range f {
+			keys = append(keys, k)
+		}
+		for k := range t {
+			if _, ok := f[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p := path + "/" + escapePointer(k)
+			fv, inFrom := f[k]
+			tv, inTo := t[k]
+			switch {
+			case !inTo:
+				changes = append(changes, change{Op: "remove", Path: p, Old: fv})
+			case !inFrom:
+				changes = append(changes, change{Op: "add", Path: p, New: tv})
+			default:
+				changes = diffJSON(p, fv, tv, changes)
+			}
+		}
+		return changes
+
+	case []interface{}:
+		t, ok := to.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(f) || i < len(t); i++ {
+			p := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(t):
+				changes = append(changes, change{Op: "remove", Path: p, Old: f[i]})
+			case i >= len(f):
+				changes = append(changes, change{Op: "add", Path: p, New: t[i]})
+			default:
+				changes = diffJSON(p, f[i], t[i], changes)
+			}
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		changes = append(changes, change{Op: "replace", Path: path, Old: from, New: to})
+	}
+	return changes
+}
+
+// escapePointer escapes a member name for use in a JSON pointer
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
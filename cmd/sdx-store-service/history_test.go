@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDiffJSON(t *testing.T) {
+	decode := func(s string) interface{} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	changes := diffJSON("",
+		decode(`{"tx_id": "a", "data": {"1": "10", "2": "x", "a/b": [1, 2]}}`),
+		decode(`{"tx_id": "b", "data": {"1": "12", "3": "y", "a/b": [1]}}`),
+		nil,
+	)
+	expected := []change{
+		{Op: "replace", Path: "/data/1", Old: "10", New: "12"},
+		{Op: "remove", Path: "/data/2", Old: "x"},
+		{Op: "add", Path: "/data/3", New: "y"},
+		{Op: "remove", Path: "/data/a~1b/1", Old: float64(2)},
+		{Op: "replace", Path: "/tx_id", Old: "a", New: "b"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+
+	if changes = diffJSON("", decode(`{"a": [1]}`), decode(`{"a": [1]}`), nil); len(changes) != 0 {
+		t.Errorf("Expected no changes for equal documents, got %+v", changes)
+	}
+}
+
+func TestSurveyHistoryHandler(t *testing.T) {
+	_, closeStore := openTestStore(t)
+	defer closeStore()
+
+	for _, submission := range []struct{ txID, body string }{
+		{"first", `{"data": {"1": "10"}}`},
+		{"second", `{"data": {"1": "12"}}`},
+	} {
+		if err := store.Put(&storage.Record{
+			Metadata: storage.Metadata{TxID: submission.txID, RuRef: "12345678901A", SurveyID: "009", InstrumentID: "0203", Period: "201710"},
+			Data:     []byte(submission.body),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/survey/{tx_id}/history", SurveyHistoryHandler).Methods("GET")
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/survey/first/history?diff=true", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", rw.Code, rw.Body.String())
+	}
+	var h history
+	if err := json.Unmarshal(rw.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Revisions) != 2 || h.RuRef != "12345678901A" {
+		t.Fatalf("Expected 2 revisions, got %+v", h)
+	}
+	latest := h.Revisions[1]
+	if latest.Revision != 2 || latest.TxID != "second" || len(latest.Changes) != 1 || latest.Changes[0].Path != "/data/1" {
+		t.Errorf("Expected revision 2 to change /data/1, got %+v", latest)
+	}
+
+	rw = httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/survey/missing/history", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown tx_id, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+
+	"github.com/gorilla/mux"
+)
+
+// setDigest sets the Digest header (RFC 3230) from a hex SHA-256, so the
+// caller has the hash of the content as the store received it
+func setDigest(rw http.ResponseWriter, sha256Hex string) {
+	b, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(b) == 0 {
+		return
+	}
+	rw.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(b))
+}
+
+// verification is the response to a verification request
+type verification struct {
+	storage.Verification
+
+	// Set if the caller presented a hash - whether it is the hash of what
+	// the store received
+	Presented string `json:"presented,omitempty"`
+	Matches   *bool  `json:"matches,omitempty"`
+}
+
+// VerifySurveyHandler re-reads a stored submission and checks it against the
+// hash taken when it was received. A hex SHA-256 passed as the sha256
+// parameter, e.g. by a downstream service proving what it delivered, is
+// checked against that hash too.
+func VerifySurveyHandler(rw http.ResponseWriter, r *http.Request) {
+	txID := mux.Vars(r)["tx_id"]
+
+	v, err := storage.Verify(store, txID)
+	if err == storage.ErrNotFound {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Survey not found",
+			Status: http.StatusNotFound,
+			Detail: "No survey is stored with this tx_id",
+		}, rw)
+		return
+	}
+	if err != nil {
+		log.Printf(`event="Failed to verify stored survey" tx_id="%s" error="%v"`, txID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to verify stored survey",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+	if v.Status == storage.Corrupt {
+		log.Printf(`event="Stored record is corrupt" tx_id="%s" detail="%s"`, txID, v.Detail)
+	}
+
+	resp := verification{Verification: *v}
+	if presented := r.URL.Query().Get("sha256"); len(presented) > 0 {
+		resp.Presented = strings.ToLower(presented)
+		matches := len(v.SHA256) > 0 && resp.Presented == v.SHA256
+		resp.Matches = &matches
+	}
+
+	body, err := json.Marshal(&resp)
+	if err != nil {
+		log.Printf(`event="Failed to marshal verification" tx_id="%s" error="%v"`, txID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to verify stored survey",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// scrubReport is the outcome of a scrub of every stored record
+type scrubReport struct {
+	StartedAt  time.Time              `json:"started_at"`
+	FinishedAt time.Time              `json:"finished_at,omitempty"`
+	Checked    int                    `json:"checked"`
+	Unhashed   int                    `json:"unhashed"`
+	Corrupt    []storage.Verification `json:"corrupt"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// lastScrub is the report of the most recent scrub
+var lastScrub struct {
+	sync.RWMutex
+	report *scrubReport
+}
+
+// scrubInterval reads SCRUB_INTERVAL from the environment
+func scrubInterval() time.Duration {
+	v := os.Getenv("SCRUB_INTERVAL")
+	if len(v) == 0 {
+		return defaultScrubInterval
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		log.Fatalf(`event="Failed to start - invalid SCRUB_INTERVAL" value="%s"`, v)
+	}
+	return interval
+}
+
+// startScrubber scrubs every interval, until the returned cancel function is
+// called
+func startScrubber(interval time.Duration) func() {
+	log.Printf(`event="Starting scrubber" interval="%s"`, interval)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				log.Print(`event="Canceling scrubber"`)
+				return
+			case <-ticker.C:
+			}
+			scrub()
+		}
+	}()
+	return func() { close(done) }
+}
+
+// scrub re-reads every stored record and checks it against its hash, logging
+// any that are corrupt
+func scrub() *scrubReport {
+	report := &scrubReport{StartedAt: time.Now().UTC(), Corrupt: []storage.Verification{}}
+	defer func() {
+		report.FinishedAt = time.Now().UTC()
+		lastScrub.Lock()
+		lastScrub.report = report
+		lastScrub.Unlock()
+		log.Printf(`event="Scrub finished" checked="%d" corrupt="%d" unhashed="%d" error="%s"`, report.Checked, len(report.Corrupt), report.Unhashed, report.Error)
+	}()
+
+	q := storage.Query{Limit: storage.MaxLimit}
+	for {
+		page, err := store.List(q)
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+
+		for _, m := range page.Records {
+			v, err := storage.Verify(store, m.TxID)
+			if err == storage.ErrNotFound {
+				// Purged since it was listed
+				continue
+			}
+			if err != nil {
+				v = &storage.Verification{TxID: m.TxID, Status: storage.Corrupt, Detail: err.Error()}
+			}
+
+			report.Checked++
+			switch v.Status {
+			case storage.Corrupt:
+				log.Printf(`event="Stored record is corrupt" tx_id="%s" detail="%s"`, v.TxID, v.Detail)
+				report.Corrupt = append(report.Corrupt, *v)
+			case storage.Unhashed:
+				report.Unhashed++
+			}
+		}
+
+		if len(page.Next) == 0 {
+			return report
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// ScrubReportHandler responds with the report of the most recent scrub
+func ScrubReportHandler(rw http.ResponseWriter, r *http.Request) {
+	lastScrub.RLock()
+	report := lastScrub.report
+	lastScrub.RUnlock()
+
+	if report == nil {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "No scrub has run yet",
+			Status: http.StatusNotFound,
+		}, rw)
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Printf(`event="Failed to marshal scrub report" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to report on scrub",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
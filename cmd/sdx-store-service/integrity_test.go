@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestIntegrity(t *testing.T) {
+	dir, closeStore := openTestStore(t)
+	defer closeStore()
+
+	body := []byte(`{"tx_id": "abc", "survey_id": "023"}`)
+	rw := httptest.NewRecorder()
+	StorePostedSurvey(rw, httptest.NewRequest("POST", "/survey", bytes.NewReader(body)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", rw.Code, rw.Body.String())
+	}
+	// sha-256 of the body, base64 encoded
+	digest := rw.Header().Get("Digest")
+	if digest != "sha-256=M/Up62CsmWlsIUVywR35tjWzM6TJWlne5QDb9sDYF/E=" {
+		t.Errorf("Expected the body's digest, got %q", digest)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/survey/{tx_id}/verify", VerifySurveyHandler).Methods("GET")
+	verify := func(query string) verification {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest("GET", "/survey/abc/verify"+query, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d %s", rw.Code, rw.Body.String())
+		}
+		var v verification
+		if err := json.Unmarshal(rw.Body.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	hash := storage.Hash(body)
+	if v := verify("?sha256=" + hash); v.Status != storage.Intact || v.Matches == nil || !*v.Matches {
+		t.Errorf("Expected an intact record matching the presented hash, got %+v", v)
+	}
+	if v := verify("?sha256=00"); v.Matches == nil || *v.Matches {
+		t.Errorf("Expected a different hash not to match, got %+v", v)
+	}
+
+	if report := scrub(); report.Checked != 1 || len(report.Corrupt) != 0 {
+		t.Errorf("Expected a clean scrub, got %+v", report)
+	}
+
+	// Bit rot
+	if err := ioutil.WriteFile(filepath.Join(dir, "abc", "data"), []byte(`{"tx_id": "abd", "survey_id": "023"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v := verify(""); v.Status != storage.Corrupt {
+		t.Errorf("Expected a corrupt record, got %+v", v)
+	}
+	if report := scrub(); len(report.Corrupt) != 1 || report.Corrupt[0].TxID != "abc" {
+		t.Errorf("Expected the scrub to find abc corrupt, got %+v", report)
+	}
+}
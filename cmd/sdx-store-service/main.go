@@ -2,29 +2,149 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
 	"github.com/ONSdigital/sdx-evolution/internal/api"
 	"github.com/gorilla/mux"
 )
 
+// Default limits on posted bodies, overridden by MAX_BODY_BYTES and
+// SEFT_MAX_BODY_BYTES
+const (
+	defaultMaxBodyBytes     = 1 << 20
+	defaultSEFTMaxBodyBytes = 64 << 20
+)
+
+// Default storage, overridden by STORAGE_BACKEND and STORAGE_PATH
+const (
+	defaultStorageBackend = storage.Filesystem
+	defaultStoragePath    = "data"
+)
+
+// defaultAdminPort is the port the operational endpoints are served on,
+// overridden by ADMIN_PORT
+const defaultAdminPort = "5001"
+
+// defaultScrubInterval is how often every record is re-read and checked
+// against its hash, overridden by SCRUB_INTERVAL
+const defaultScrubInterval = 24 * time.Hour
+
+// Defaults for retention, overridden by RETENTION_INTERVAL,
+// RETENTION_ARCHIVE_DIR and RETENTION_AUDIT_FILE
+const (
+	defaultRetentionInterval   = 24 * time.Hour
+	defaultRetentionArchiveDir = "archive"
+	defaultRetentionAuditFile  = "retention-audit.jsonl"
+)
+
+var store storage.Store
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		reencrypt()
+		return
+	}
+
 	var port string
 	if port = os.Getenv("PORT"); len(port) == 0 {
 		log.Fatal(`event="Failed to start - Must supply PORT environment variable"`)
 	}
 
+	maxBodyBytes := bodyLimit("MAX_BODY_BYTES", defaultMaxBodyBytes)
+	seftMaxBodyBytes := bodyLimit("SEFT_MAX_BODY_BYTES", defaultSEFTMaxBodyBytes)
+
+	raw, keys := openStorage()
+	defer raw.Close()
+	if keys == nil {
+		log.Print(`event="Storing records unencrypted - MASTER_KEY_FILE is not set"`)
+		store = raw
+	} else {
+		log.Printf(`event="Encrypting stored records" kid="%s"`, keys.Current())
+		store = storage.Encrypted(raw, keys)
+	}
+
+	if rulesFile := os.Getenv("RETENTION_FILE"); len(rulesFile) > 0 {
+		var interval time.Duration
+		purger, interval = newPurger(raw, rulesFile)
+		defer purger.Start(interval)()
+	}
+	defer startScrubber(scrubInterval())()
+
 	r := mux.NewRouter()
 	r.HandleFunc("/healthcheck", HealthcheckHandler).Methods("GET")
-	r.HandleFunc("/survey", StorePostedSurvey).Methods("POST")
+	r.Handle("/survey", api.Body(maxBodyBytes, "application/json")(http.HandlerFunc(StorePostedSurvey))).Methods("POST")
+	r.HandleFunc("/survey/{tx_id}", GetStoredSurvey).Methods("GET")
+	r.HandleFunc("/survey/{tx_id}/history", SurveyHistoryHandler).Methods("GET")
+	r.HandleFunc("/survey/{tx_id}/verify", VerifySurveyHandler).Methods("GET")
+	r.HandleFunc("/surveys", ListStoredSurveys).Methods("GET")
+	r.Handle("/seft", api.Body(seftMaxBodyBytes, "multipart/form-data")(http.HandlerFunc(StorePostedSEFT))).Methods("POST")
+
+	// Operational endpoints are served on their own port, which isn't
+	// exposed beyond the service's network, rather than next to the records
+	adminPort := os.Getenv("ADMIN_PORT")
+	if len(adminPort) == 0 {
+		adminPort = defaultAdminPort
+	}
+	admin := mux.NewRouter()
+	admin.HandleFunc("/admin/retention", RetentionReportHandler).Methods("GET")
+	admin.HandleFunc("/admin/scrub", ScrubReportHandler).Methods("GET")
+	go func() {
+		log.Fatalf(`event="Admin webserver stopped" error="%v"`, http.ListenAndServe(fmt.Sprintf(":%s", adminPort), admin))
+	}()
+
 	http.Handle("/", r)
 	log.Print(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 }
 
+// openStorage opens the configured storage, without encryption, and loads
+// the master keys if there are any
+func openStorage() (storage.Store, *storage.MasterKeys) {
+	backend, path := os.Getenv("STORAGE_BACKEND"), os.Getenv("STORAGE_PATH")
+	if len(backend) == 0 {
+		backend = defaultStorageBackend
+	}
+	if len(path) == 0 {
+		path = defaultStoragePath
+	}
+
+	var keys *storage.MasterKeys
+	if keyFile := os.Getenv("MASTER_KEY_FILE"); len(keyFile) > 0 {
+		var err error
+		if keys, err = storage.LoadMasterKeys(keyFile); err != nil {
+			log.Fatalf(`event="Failed to start - unable to load master keys" path="%s" error="%v"`, keyFile, err)
+		}
+	}
+
+	s, err := storage.Open(backend, path)
+	if err != nil {
+		log.Fatalf(`event="Failed to start - unable to open storage" backend="%s" path="%s" error="%v"`, backend, path, err)
+	}
+	log.Printf(`event="Opened storage" backend="%s" path="%s"`, backend, path)
+	return s, keys
+}
+
+// bodyLimit reads a body size limit from the environment, falling back to the
+// default if it isn't set
+func bodyLimit(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if len(v) == 0 {
+		return def
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit < 1 {
+		log.Fatalf(`event="Failed to start - invalid %s" value="%s"`, name, v)
+	}
+	return limit
+}
+
 // StorePostedSurvey attempts to place the given survey data into the data store
 func StorePostedSurvey(rw http.ResponseWriter, r *http.Request) {
 
@@ -48,7 +168,131 @@ func StorePostedSurvey(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf(`event="Would be attempting to store survey" tx_id="%s"`, survey.TxID)
+	putRecord(rw, &storage.Record{
+		Metadata: storage.Metadata{
+			TxID:         survey.TxID,
+			Kind:         storage.KindSurvey,
+			ContentType:  r.Header.Get("Content-Type"),
+			SurveyID:     survey.SurveyID,
+			InstrumentID: survey.Collection.InstrumentID,
+			Period:       survey.Collection.Period,
+			ExerciseSID:  survey.Collection.ExerciseSID,
+			Origin:       survey.Origin,
+			RuRef:        survey.Metadata.RuRef,
+		},
+		Data: body,
+	})
+}
+
+// seftMaxMemory is how much of a posted SEFT return is held in memory - the
+// rest goes to temporary files
+const seftMaxMemory = 32 << 20
+
+// StorePostedSEFT attempts to place the given SEFT return - its metadata and
+// attachment, posted as multipart/form-data - into the data store
+func StorePostedSEFT(rw http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseMultipartForm(seftMaxMemory); err != nil {
+		log.Printf(`event="Failed to read posted SEFT return" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to read posted data",
+			Status: http.StatusBadRequest,
+		}, rw)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	rawMetadata := []byte(r.FormValue("metadata"))
+	var metadata SEFTMetadata
+	if err := json.Unmarshal(rawMetadata, &metadata); err != nil || len(metadata.TxID) == 0 {
+		log.Printf(`event="Failed to parse posted SEFT metadata" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to parse posted data",
+			Status: http.StatusBadRequest,
+		}, rw)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		log.Printf(`event="SEFT return has no attachment" tx_id="%s" error="%v"`, metadata.TxID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Missing attachment",
+			Status: http.StatusBadRequest,
+		}, rw)
+		return
+	}
+	attachment, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		log.Printf(`event="Failed to read SEFT attachment" tx_id="%s" error="%v"`, metadata.TxID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to read posted data",
+			Status: http.StatusBadRequest,
+		}, rw)
+		return
+	}
+
+	putRecord(rw, &storage.Record{
+		Metadata: storage.Metadata{
+			TxID:           metadata.TxID,
+			Kind:           storage.KindSEFT,
+			ContentType:    "application/json",
+			SurveyID:       metadata.SurveyID,
+			InstrumentID:   metadata.InstrumentID,
+			Period:         metadata.Period,
+			ExerciseSID:    metadata.ExerciseSID,
+			RuRef:          metadata.RuRef,
+			AttachmentName: header.Filename,
+			AttachmentType: header.Header.Get("Content-Type"),
+		},
+		Data:       rawMetadata,
+		Attachment: attachment,
+	})
+}
+
+// putRecord stores a record and writes the response. The record is on disk
+// before the 200 goes back, so the caller can treat it as safe.
+func putRecord(rw http.ResponseWriter, record *storage.Record) {
+	record.ReceivedAt = time.Now().UTC()
+
+	err := store.Put(record)
+	switch {
+	case err == nil:
+	case errors.Is(err, storage.ErrInvalidTxID):
+		log.Printf(`event="Refusing to store record with invalid tx_id" tx_id="%s" kind="%s"`, record.TxID, record.Kind)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Invalid tx_id",
+			Status: http.StatusBadRequest,
+		}, rw)
+		return
+	case errors.Is(err, storage.ErrConflict):
+		log.Printf(`event="Refusing to overwrite stored record" tx_id="%s" kind="%s"`, record.TxID, record.Kind)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "A different submission is already stored with this tx_id",
+			Status: http.StatusConflict,
+		}, rw)
+		return
+	default:
+		log.Printf(`event="Failed to store record" tx_id="%s" kind="%s" error="%v"`, record.TxID, record.Kind, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to store posted data",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	log.Printf(
+		`event="Stored record" tx_id="%s" kind="%s" revision="%d" size="%d" attachment_size="%d" received_at="%s" sha256="%s"`,
+		record.TxID,
+		record.Kind,
+		record.Revision,
+		record.Size,
+		record.AttachmentSize,
+		record.ReceivedAt.Format(time.RFC3339Nano),
+		record.SHA256,
+	)
 
+	setDigest(rw, record.SHA256)
 	rw.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+)
+
+// reencrypt is the reencrypt command. It brings every stored record up to
+// date with the current master key - run it after rotating the key, or
+// turning encryption on, and the old key can be dropped from the key file
+// once it has finished. It takes the same environment as the service, which
+// should be stopped while it runs.
+func reencrypt() {
+	s, keys := openStorage()
+	defer s.Close()
+	if keys == nil {
+		log.Fatal(`event="Failed to re-encrypt - Must supply MASTER_KEY_FILE environment variable"`)
+	}
+
+	log.Printf(`event="Re-encrypting stored records" kid="%s"`, keys.Current())
+	count, err := storage.Reencrypt(s, keys, func(m *storage.Metadata) {
+		log.Printf(`event="Re-encrypted record" tx_id="%s" kid="%s"`, m.TxID, m.Encryption.KeyID)
+	})
+	if err != nil {
+		s.Close()
+		log.Fatalf(`event="Failed to re-encrypt" count="%d" error="%v"`, count, err)
+	}
+	log.Printf(`event="Re-encrypted stored records" count="%d" kid="%s"`, count, keys.Current())
+}
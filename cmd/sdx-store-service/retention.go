@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/retention"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+// purger purges expired submissions. Nil if there are no retention rules.
+var purger *retention.Purger
+
+// newPurger loads the retention rules and returns a purger for them, along
+// with how often it should run
+func newPurger(s storage.Store, rulesFile string) (*retention.Purger, time.Duration) {
+	policy, err := retention.Load(rulesFile)
+	if err != nil {
+		log.Fatalf(`event="Failed to start - invalid RETENTION_FILE" path="%s" error="%v"`, rulesFile, err)
+	}
+
+	interval := defaultRetentionInterval
+	if v := os.Getenv("RETENTION_INTERVAL"); len(v) > 0 {
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			log.Fatalf(`event="Failed to start - invalid RETENTION_INTERVAL" value="%s"`, v)
+		}
+	}
+	archiveDir := os.Getenv("RETENTION_ARCHIVE_DIR")
+	if len(archiveDir) == 0 {
+		archiveDir = defaultRetentionArchiveDir
+	}
+	auditFile := os.Getenv("RETENTION_AUDIT_FILE")
+	if len(auditFile) == 0 {
+		auditFile = defaultRetentionAuditFile
+	}
+
+	log.Printf(`event="Starting retention purge" rules="%s" interval="%s" archive_dir="%s" audit_file="%s"`, rulesFile, interval, archiveDir, auditFile)
+	return retention.NewPurger(s, policy, archiveDir, auditFile), interval
+}
+
+// RetentionReportHandler responds with a dry run of the retention purge -
+// what would be purged if it ran now.
+func RetentionReportHandler(rw http.ResponseWriter, r *http.Request) {
+	if purger == nil {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "No retention rules",
+			Status: http.StatusNotFound,
+			Detail: "RETENTION_FILE is not set, so nothing is purged",
+		}, rw)
+		return
+	}
+
+	report, err := purger.Run(time.Now().UTC(), true)
+	if err != nil {
+		log.Printf(`event="Failed to report on retention" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to report on retention",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Printf(`event="Failed to marshal retention report" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to report on retention",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
@@ -0,0 +1,337 @@
+// Package retention removes stored submissions once they are past the time
+// they may be kept for, which varies by survey.
+//
+// Rules are loaded from a JSON file, e.g.
+//
+//	[
+//		{"survey_id": "144", "keep_years": 10, "action": "archive"},
+//		{"survey_id": "*", "keep_years": 2, "action": "delete"}
+//	]
+//
+// A survey's own rule takes precedence over the "*" rule. Submissions for a
+// survey with no rule (and no "*" rule) are kept indefinitely. Expired
+// submissions are either deleted, or archived then deleted. Archives are
+// written as they were stored, so are still encrypted if the store is. Every
+// submission purged is recorded in an audit log of JSON lines.
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+)
+
+// Actions taken on an expired submission
+const (
+	Delete  = "delete"
+	Archive = "archive"
+)
+
+// AnySurvey is the survey ID of the rule for surveys without their own
+const AnySurvey = "*"
+
+// surveyIDPattern is what a survey ID must look like to name an archive
+// directory. Anything else is archived under "unknown".
+var surveyIDPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,16}$`)
+
+// Rule is how long submissions for a survey are kept
+type Rule struct {
+	SurveyID  string `json:"survey_id"`
+	KeepYears int    `json:"keep_years"`
+	KeepDays  int    `json:"keep_days"`
+	Action    string `json:"action"`
+}
+
+// cutoff is the time before which submissions received have expired
+func (r *Rule) cutoff(now time.Time) time.Time {
+	return now.AddDate(-r.KeepYears, 0, -r.KeepDays)
+}
+
+// Policy is a set of rules, one per survey
+type Policy struct {
+	rules map[string]*Rule
+}
+
+// Load loads a policy from a JSON file
+func Load(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*Rule
+	if err = json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse retention rules: %w", err)
+	}
+
+	p := &Policy{rules: make(map[string]*Rule, len(rules))}
+	for _, r := range rules {
+		switch {
+		case len(r.SurveyID) == 0:
+			return nil, errors.New("retention rule has no survey_id")
+		case r.KeepYears < 0 || r.KeepDays < 0 || r.KeepYears+r.KeepDays == 0:
+			return nil, fmt.Errorf("retention rule for %s must keep for a positive number of years and/or days", r.SurveyID)
+		case r.Action != Delete && r.Action != Archive:
+			return nil, fmt.Errorf("retention rule for %s has action %q - expected %q or %q", r.SurveyID, r.Action, Delete, Archive)
+		}
+		if _, ok := p.rules[r.SurveyID]; ok {
+			return nil, fmt.Errorf("more than one retention rule for %s", r.SurveyID)
+		}
+		p.rules[r.SurveyID] = r
+	}
+	return p, nil
+}
+
+// Archives reports whether any rule archives submissions
+func (p *Policy) Archives() bool {
+	for _, r := range p.rules {
+		if r.Action == Archive {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleFor returns the rule for a survey, or nil if submissions for it are
+// kept indefinitely
+func (p *Policy) ruleFor(surveyID string) *Rule {
+	if r, ok := p.rules[surveyID]; ok {
+		return r
+	}
+	return p.rules[AnySurvey]
+}
+
+// Expired is a submission past its retention period
+type Expired struct {
+	TxID       string    `json:"tx_id"`
+	SurveyID   string    `json:"survey_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	ExpiredAt  time.Time `json:"expired_at"`
+	Action     string    `json:"action"`
+}
+
+// Report is what a purge did, or for a dry run would do
+type Report struct {
+	RunAt   time.Time `json:"run_at"`
+	DryRun  bool      `json:"dry_run"`
+	Count   int       `json:"count"`
+	Expired []Expired `json:"expired"`
+}
+
+// auditRecord is a line in the audit log
+type auditRecord struct {
+	Expired
+	PurgedAt    time.Time `json:"purged_at"`
+	ArchivePath string    `json:"archive_path,omitempty"`
+}
+
+// Purger applies a policy to a store
+type Purger struct {
+	store      storage.Store
+	policy     *Policy
+	archiveDir string
+	auditPath  string
+
+	// mu stops purges overlapping
+	mu sync.Mutex
+}
+
+// NewPurger creates a Purger. The store should be the underlying one, not
+// one that decrypts, so that archives stay encrypted.
+func NewPurger(s storage.Store, policy *Policy, archiveDir, auditPath string) *Purger {
+	return &Purger{store: s, policy: policy, archiveDir: archiveDir, auditPath: auditPath}
+}
+
+// Start runs a purge every interval, until the returned cancel function is
+// called
+func (p *Purger) Start(interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				log.Print(`event="Canceling retention purge"`)
+				return
+			case <-ticker.C:
+			}
+
+			report, err := p.Run(time.Now().UTC(), false)
+			if err != nil {
+				log.Printf(`event="Retention purge failed" purged="%d" error="%v"`, report.Count, err)
+				continue
+			}
+			log.Printf(`event="Retention purge finished" purged="%d"`, report.Count)
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Run purges everything that has expired as of now. With dryRun it only
+// reports what would be purged. The report is returned even on error, with
+// what had been purged by then.
+func (p *Purger) Run(now time.Time, dryRun bool) (*Report, error) {
+	report := &Report{RunAt: now, DryRun: dryRun, Expired: []Expired{}}
+
+	expired, err := p.policy.expired(p.store, now)
+	if err != nil {
+		return report, err
+	}
+	if dryRun {
+		report.Expired = expired
+		report.Count = len(expired)
+		return report, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, e := range expired {
+		if err = p.purge(e, now); err != nil {
+			return report, fmt.Errorf("failed to purge %s: %w", e.TxID, err)
+		}
+		report.Expired = append(report.Expired, e)
+		report.Count++
+	}
+	return report, nil
+}
+
+// expired finds the submissions that have expired as of now
+func (p *Policy) expired(s storage.Store, now time.Time) ([]Expired, error) {
+	expired := []Expired{}
+	for surveyID, rule := range p.rules {
+		q := storage.Query{ReceivedTo: rule.cutoff(now), Limit: storage.MaxLimit}
+		if surveyID != AnySurvey {
+			q.SurveyID = surveyID
+		}
+
+		for {
+			page, err := s.List(q)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range page.Records {
+				// The catch-all rule doesn't apply to surveys with their own
+				if p.ruleFor(m.SurveyID) != rule {
+					continue
+				}
+				expired = append(expired, Expired{
+					TxID:       m.TxID,
+					SurveyID:   m.SurveyID,
+					ReceivedAt: m.ReceivedAt,
+					ExpiredAt:  m.ReceivedAt.AddDate(rule.KeepYears, 0, rule.KeepDays),
+					Action:     rule.Action,
+				})
+			}
+			if len(page.Next) == 0 {
+				break
+			}
+			q.Cursor = page.Next
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ReceivedAt.Before(expired[j].ReceivedAt) })
+	return expired, nil
+}
+
+// purge archives (if need be), audits, then deletes a submission. It is
+// audited before it is deleted so that nothing is ever deleted without a
+// record of it - if the delete then fails, the next run purges and audits it
+// again.
+func (p *Purger) purge(e Expired, now time.Time) error {
+	audit := auditRecord{Expired: e, PurgedAt: now}
+
+	if e.Action == Archive {
+		r, err := p.store.Get(e.TxID)
+		if err != nil {
+			return err
+		}
+		if audit.ArchivePath, err = p.archive(r); err != nil {
+			return err
+		}
+	}
+
+	if err := p.audit(&audit); err != nil {
+		return err
+	}
+	if err := p.store.Delete(e.TxID); err != nil {
+		return err
+	}
+	log.Printf(`event="Purged expired submission" tx_id="%s" survey_id="%s" action="%s"`, e.TxID, e.SurveyID, e.Action)
+	return nil
+}
+
+// archive writes a record, as stored, to <archive dir>/<survey_id>/<tx_id>.json
+// and returns the path
+func (p *Purger) archive(r *storage.Record) (string, error) {
+	dir := filepath.Join(p.archiveDir, r.SurveyID)
+	if !surveyIDPattern.MatchString(r.SurveyID) {
+		dir = filepath.Join(p.archiveDir, "unknown")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, r.TxID+".json")
+	tmp := path + ".tmp"
+	if err = writeSync(tmp, b, os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return path, syncDir(dir)
+}
+
+// audit appends a line to the audit log
+func (p *Purger) audit(a *auditRecord) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return writeSync(p.auditPath, append(b, '\n'), os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+}
+
+// writeSync writes to a file and syncs it to disk
+func writeSync(path string, b []byte, flag int) error {
+	f, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir syncs a directory so that entries created in it are durable
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
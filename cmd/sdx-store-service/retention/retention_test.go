@@ -0,0 +1,183 @@
+package retention
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for rules, valid := range map[string]bool{
+		`[{"survey_id": "144", "keep_years": 10, "action": "archive"}, {"survey_id": "*", "keep_days": 30, "action": "delete"}]`: true,
+		`[{"survey_id": "144", "keep_years": 10, "action": "shred"}]`:                                                            false,
+		`[{"survey_id": "144", "action": "delete"}]`:                                                                             false,
+		`[{"keep_years": 1, "action": "delete"}]`:                                                                                false,
+		`[{"survey_id": "144", "keep_years": 1, "action": "delete"}, {"survey_id": "144", "keep_years": 2, "action": "delete"}]`: false,
+		`{}`: false,
+	} {
+		path := filepath.Join(dir, "rules.json")
+		if err = ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Load(path); (err == nil) != valid {
+			t.Errorf("Expected valid=%v for %s, got %v", valid, rules, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := storage.Open(storage.Filesystem, filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for txID, m := range map[string]storage.Metadata{
+		"ukis-old":   {SurveyID: "144", ReceivedAt: now.AddDate(-11, 0, 0)},
+		"ukis-new":   {SurveyID: "144", ReceivedAt: now.AddDate(-9, 0, 0)},
+		"mbs-old":    {SurveyID: "009", ReceivedAt: now.AddDate(0, 0, -31)},
+		"mbs-new":    {SurveyID: "009", ReceivedAt: now.AddDate(0, 0, -29)},
+		"census-old": {SurveyID: "999", ReceivedAt: now.AddDate(-50, 0, 0)},
+	} {
+		m.TxID = txID
+		if err = s.Put(&storage.Record{Metadata: m, Data: []byte(txID)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules := filepath.Join(dir, "rules.json")
+	if err = ioutil.WriteFile(rules, []byte(`[
+		{"survey_id": "144", "keep_years": 10, "action": "archive"},
+		{"survey_id": "009", "keep_days": 30, "action": "delete"}
+	]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := Load(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	p := NewPurger(s, policy, filepath.Join(dir, "archive"), auditPath)
+
+	report, err := p.Run(now, true)
+	if err != nil {
+		t.Fatalf("Expected dry run to succeed, got %v", err)
+	}
+	if report.Count != 2 || report.Expired[0].TxID != "ukis-old" || report.Expired[1].TxID != "mbs-old" {
+		t.Errorf("Expected ukis-old and mbs-old to have expired, got %+v", report.Expired)
+	}
+	if _, err = s.Get("ukis-old"); err != nil {
+		t.Errorf("Expected a dry run to leave records alone, got %v", err)
+	}
+
+	if report, err = p.Run(now, false); err != nil || report.Count != 2 {
+		t.Fatalf("Expected 2 records purged, got %+v %v", report, err)
+	}
+	for _, txID := range []string{"ukis-old", "mbs-old"} {
+		if _, err = s.Get(txID); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected %s to be purged, got %v", txID, err)
+		}
+	}
+	for _, txID := range []string{"ukis-new", "mbs-new", "census-old"} {
+		if _, err = s.Get(txID); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", txID, err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "archive", "144", "ukis-old.json"))
+	if err != nil {
+		t.Fatalf("Expected ukis-old to be archived, got %v", err)
+	}
+	var archived storage.Record
+	if err = json.Unmarshal(b, &archived); err != nil || string(archived.Data) != "ukis-old" {
+		t.Errorf("Expected the archived record, got %s %v", b, err)
+	}
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var audited []auditRecord
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var a auditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			t.Fatal(err)
+		}
+		audited = append(audited, a)
+	}
+	if len(audited) != 2 || audited[0].Action != Archive || len(audited[0].ArchivePath) == 0 || audited[1].Action != Delete {
+		t.Errorf("Expected an audit record per purge, got %+v", audited)
+	}
+}
+
+// failingDelete is a store that can't delete
+type failingDelete struct{ storage.Store }
+
+func (failingDelete) Delete(txID string) error { return errors.New("disk on fire") }
+
+func TestPurgeAuditsFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := storage.Open(storage.Filesystem, filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := storage.Metadata{TxID: "odd-survey", SurveyID: "1.44", ReceivedAt: now.AddDate(-11, 0, 0)}
+	if err = s.Put(&storage.Record{Metadata: m, Data: []byte(m.TxID)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := filepath.Join(dir, "rules.json")
+	if err = ioutil.WriteFile(rules, []byte(`[{"survey_id": "*", "keep_years": 10, "action": "archive"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := Load(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	p := NewPurger(failingDelete{s}, policy, filepath.Join(dir, "archive"), auditPath)
+
+	if report, err := p.Run(now, false); err == nil || report.Count != 0 {
+		t.Fatalf("Expected the purge to fail, got %+v %v", report, err)
+	}
+	if b, err := ioutil.ReadFile(auditPath); err != nil || len(b) == 0 {
+		t.Errorf("Expected the purge to be audited before the delete, got %q %v", b, err)
+	}
+	if _, err = s.Get("odd-survey"); err != nil {
+		t.Errorf("Expected the record to be kept when the delete fails, got %v", err)
+	}
+
+	// A survey ID that isn't a plain ID doesn't name the archive directory
+	if _, err = os.Stat(filepath.Join(dir, "archive", "unknown", "odd-survey.json")); err != nil {
+		t.Errorf("Expected the record to be archived under unknown, got %v", err)
+	}
+}
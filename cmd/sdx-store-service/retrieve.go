@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+
+	"github.com/gorilla/mux"
+)
+
+// GetStoredSurvey responds with a stored survey exactly as it was posted, so
+// that downstream services given a tx_id can fetch what they are to process.
+// The ETag is derived from the stored bytes, so a conditional request with
+// If-None-Match gets a 304 if the caller already has them.
+func GetStoredSurvey(rw http.ResponseWriter, r *http.Request) {
+	txID := mux.Vars(r)["tx_id"]
+
+	record, err := store.Get(txID)
+	if err == nil && record.Kind != storage.KindSurvey {
+		err = storage.ErrNotFound
+	}
+	if err == storage.ErrNotFound {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Survey not found",
+			Status: http.StatusNotFound,
+			Detail: "No survey is stored with this tx_id",
+		}, rw)
+		return
+	}
+	if err != nil {
+		log.Printf(`event="Failed to get stored survey" tx_id="%s" error="%v"`, txID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to get stored survey",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	etag := entityTag(record.Data)
+	rw.Header().Set("ETag", etag)
+	setDigest(rw, record.SHA256)
+	rw.Header().Set("Last-Modified", record.ReceivedAt.UTC().Format(http.TimeFormat))
+
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	contentType := record.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(record.Data)))
+	rw.Header().Set("X-Received-At", record.ReceivedAt.UTC().Format(time.RFC3339Nano))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(record.Data)
+}
+
+// entityTag is the strong ETag for a stored body
+func entityTag(data []byte) string {
+	digest := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(digest[:]) + `"`
+}
+
+// matchesETag reports whether an If-None-Match header matches an ETag. As
+// per RFC 7232 the comparison is weak, so W/ prefixes are ignored.
+func matchesETag(ifNoneMatch, etag string) bool {
+	ifNoneMatch = strings.TrimSpace(ifNoneMatch)
+	if len(ifNoneMatch) == 0 {
+		return false
+	}
+	if ifNoneMatch == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
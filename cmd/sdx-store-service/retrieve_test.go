@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// openTestStore opens a filesystem store in a new temporary directory as the
+// store the handlers use. It returns the directory and a function to close
+// the store and remove the directory with.
+func openTestStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store, err = storage.Open(storage.Filesystem, dir); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetStoredSurvey(t *testing.T) {
+	_, closeStore := openTestStore(t)
+	defer closeStore()
+
+	body := []byte(`{"tx_id": "abc", "survey_id": "023"}`)
+	if err := store.Put(&storage.Record{
+		Metadata: storage.Metadata{TxID: "abc", Kind: storage.KindSurvey, ContentType: "application/json"},
+		Data:     body,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/survey/{tx_id}", GetStoredSurvey).Methods("GET")
+
+	get := func(txID, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/survey/"+txID, nil)
+		if len(ifNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := get("abc", "")
+	if rw.Code != http.StatusOK || !bytes.Equal(rw.Body.Bytes(), body) {
+		t.Fatalf("Expected 200 with the stored bytes, got %d %q", rw.Code, rw.Body.String())
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the stored content type, got %q", ct)
+	}
+	etag := rw.Header().Get("ETag")
+	if len(etag) == 0 {
+		t.Fatal("Expected an ETag")
+	}
+
+	for ifNoneMatch, expected := range map[string]int{
+		etag:               http.StatusNotModified,
+		"W/" + etag:        http.StatusNotModified,
+		`"other", ` + etag: http.StatusNotModified,
+		"*":                http.StatusNotModified,
+		`"other"`:          http.StatusOK,
+	} {
+		if rw = get("abc", ifNoneMatch); rw.Code != expected {
+			t.Errorf("Expected %d for If-None-Match %s, got %d", expected, ifNoneMatch, rw.Code)
+		}
+	}
+
+	if rw = get("missing", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown tx_id, got %d", rw.Code)
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Expected a problem response, got %q", ct)
+	}
+}
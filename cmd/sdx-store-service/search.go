@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+// searchResults is the response to a search of stored submissions
+type searchResults struct {
+	Count      int                `json:"count"`
+	Results    []storage.Metadata `json:"results"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// searchTotal is the response to a count only search
+type searchTotal struct {
+	Total int `json:"total"`
+}
+
+// ListStoredSurveys responds with the metadata of stored submissions
+// matching the query parameters, oldest first. Results are paged - if there
+// are more, the response has a next_cursor to pass as the cursor parameter
+// to get them. With count_only=true it responds with just the total number
+// matching instead.
+func ListStoredSurveys(rw http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := storage.Query{
+		SurveyID:     params.Get("survey_id"),
+		InstrumentID: params.Get("instrument_id"),
+		Period:       params.Get("period"),
+		ExerciseSID:  params.Get("exercise_sid"),
+		Origin:       params.Get("origin"),
+		Cursor:       params.Get("cursor"),
+	}
+
+	var invalid []api.InvalidParam
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"received_from", &q.ReceivedFrom},
+		{"received_to", &q.ReceivedTo},
+	} {
+		v := params.Get(p.name)
+		if len(v) == 0 {
+			continue
+		}
+		var err error
+		if *p.t, err = time.Parse(time.RFC3339, v); err != nil {
+			invalid = append(invalid, api.InvalidParam{Name: p.name, Reason: "must be an RFC 3339 date-time"})
+		}
+	}
+	if v := params.Get("limit"); len(v) > 0 {
+		var err error
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > storage.MaxLimit {
+			invalid = append(invalid, api.InvalidParam{Name: "limit", Reason: "must be between 1 and " + strconv.Itoa(storage.MaxLimit)})
+		}
+	}
+	if len(invalid) > 0 {
+		api.WriteProblemResponse(api.Problem{
+			Title:         "Invalid search",
+			Status:        http.StatusBadRequest,
+			InvalidParams: invalid,
+		}, rw)
+		return
+	}
+
+	if countOnly, _ := strconv.ParseBool(params.Get("count_only")); countOnly {
+		countStoredSurveys(rw, r, q)
+		return
+	}
+
+	page, err := store.List(q)
+	if err == storage.ErrInvalidCursor {
+		api.WriteProblemResponse(api.Problem{
+			Title:         "Invalid search",
+			Status:        http.StatusBadRequest,
+			InvalidParams: []api.InvalidParam{{Name: "cursor", Reason: "must be a next_cursor from a previous search"}},
+		}, rw)
+		return
+	}
+	if err != nil {
+		log.Printf(`event="Failed to search stored surveys" query="%s" error="%v"`, r.URL.RawQuery, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to search stored surveys",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	body, err := json.Marshal(&searchResults{
+		Count:      len(page.Records),
+		Results:    page.Records,
+		NextCursor: page.Next,
+	})
+	if err != nil {
+		log.Printf(`event="Failed to marshal search results" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to search stored surveys",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// countStoredSurveys responds with the total number of stored submissions
+// matching a search
+func countStoredSurveys(rw http.ResponseWriter, r *http.Request, q storage.Query) {
+	n, err := store.Count(q)
+	if err != nil {
+		log.Printf(`event="Failed to count stored surveys" query="%s" error="%v"`, r.URL.RawQuery, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to search stored surveys",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	body, err := json.Marshal(&searchTotal{Total: n})
+	if err != nil {
+		log.Printf(`event="Failed to marshal search total" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to search stored surveys",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
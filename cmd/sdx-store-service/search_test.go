@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-store-service/storage"
+)
+
+func TestListStoredSurveys(t *testing.T) {
+	_, closeStore := openTestStore(t)
+	defer closeStore()
+
+	received := time.Date(2017, 10, 1, 9, 0, 0, 0, time.UTC)
+	for _, txID := range []string{"a", "b", "c"} {
+		received = received.Add(time.Hour)
+		if err := store.Put(&storage.Record{
+			Metadata: storage.Metadata{TxID: txID, Kind: storage.KindSurvey, SurveyID: "023", InstrumentID: "0203", Period: "201710", ReceivedAt: received},
+			Data:     []byte(txID),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(query string) (int, searchResults) {
+		rw := httptest.NewRecorder()
+		ListStoredSurveys(rw, httptest.NewRequest("GET", "/surveys?"+query, nil))
+		var results searchResults
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rw.Code, results
+	}
+
+	code, results := search("survey_id=023&instrument_id=0203&period=201710&limit=2")
+	if code != http.StatusOK || results.Count != 2 || len(results.NextCursor) == 0 {
+		t.Fatalf("Expected a first page of 2 with a cursor, got %d %+v", code, results)
+	}
+	code, results = search("survey_id=023&instrument_id=0203&period=201710&limit=2&cursor=" + results.NextCursor)
+	if code != http.StatusOK || results.Count != 1 || results.Results[0].TxID != "c" || len(results.NextCursor) > 0 {
+		t.Errorf("Expected a last page of c, got %d %+v", code, results)
+	}
+
+	code, results = search("received_from=2017-10-01T10:30:00Z&received_to=2017-10-01T12:00:00Z")
+	if code != http.StatusOK || results.Count != 1 || results.Results[0].TxID != "b" {
+		t.Errorf("Expected b in the received range, got %d %+v", code, results)
+	}
+
+	// The total across every page, without the records
+	rw := httptest.NewRecorder()
+	ListStoredSurveys(rw, httptest.NewRequest("GET", "/surveys?survey_id=023&instrument_id=0203&limit=2&count_only=true", nil))
+	var total searchTotal
+	if err := json.Unmarshal(rw.Body.Bytes(), &total); rw.Code != http.StatusOK || err != nil || total.Total != 3 {
+		t.Errorf("Expected a total of 3, got %d %s", rw.Code, rw.Body)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "received_from=yesterday", "cursor=!"} {
+		if code, _ = search(query); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", query, code)
+		}
+	}
+}
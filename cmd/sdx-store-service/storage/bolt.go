@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets in the bolt store. The index bucket holds the index keys (with
+// empty values), the others are keyed by tx_id.
+var (
+	metadataBucket   = []byte("metadata")
+	dataBucket       = []byte("data")
+	attachmentBucket = []byte("attachments")
+	indexBucket      = []byte("index")
+	infoBucket       = []byte("info")
+)
+
+// indexVersion changes whenever what is indexed does, so that the indexes of
+// an existing database are rebuilt
+var (
+	indexVersionKey = []byte("index_version")
+	indexVersion    = []byte("2")
+)
+
+// boltStore keeps records in an embedded bolt database. Each put is a single
+// transaction, which bolt syncs to disk before it commits.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{metadataBucket, dataBucket, attachmentBucket, infoBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+
+		info := tx.Bucket(infoBucket)
+		if bytes.Equal(info.Get(indexVersionKey), indexVersion) {
+			return nil
+		}
+
+		// The indexes are missing or out of date, so build them afresh
+		if tx.Bucket(indexBucket) != nil {
+			if err := tx.DeleteBucket(indexBucket); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(indexBucket); err != nil {
+			return err
+		}
+		if err := tx.Bucket(metadataBucket).ForEach(func(_, v []byte) error {
+			var m Metadata
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			return putIndex(tx, &m)
+		}); err != nil {
+			return err
+		}
+		return info.Put(indexVersionKey, indexVersion)
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Put(r *Record) error {
+	if err := prepare(r); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(r.TxID)
+
+		stored, err := get(tx, key)
+		if err == nil {
+			if !sameContent(stored, r) {
+				return ErrConflict
+			}
+			r.Metadata = stored.Metadata
+			return nil
+		}
+		if err != ErrNotFound {
+			return err
+		}
+		if err = assignRevision(r, txScan(tx), txMetadata(tx)); err != nil {
+			return err
+		}
+		return put(tx, r)
+	})
+}
+
+func (s *boltStore) Replace(r *Record) error {
+	if err := prepare(r); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(r.TxID)
+
+		if err := remove(tx, key); err != nil {
+			return err
+		}
+		return put(tx, r)
+	})
+}
+
+func (s *boltStore) Delete(txID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return remove(tx, []byte(txID))
+	})
+}
+
+func (s *boltStore) Get(txID string) (*Record, error) {
+	var r *Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = get(tx, []byte(txID))
+		return err
+	})
+	return r, err
+}
+
+func (s *boltStore) List(q Query) (*Page, error) {
+	var page *Page
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		page, err = list(q, txScan(tx), txMetadata(tx))
+		return err
+	})
+	return page, err
+}
+
+func (s *boltStore) Count(q Query) (int, error) {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = count(q, txScan(tx), txMetadata(tx))
+		return err
+	})
+	return n, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// get reads a record within a transaction. The values are copied as they
+// are only valid for the life of the transaction.
+func get(tx *bolt.Tx, key []byte) (*Record, error) {
+	metadata := tx.Bucket(metadataBucket).Get(key)
+	if metadata == nil {
+		return nil, ErrNotFound
+	}
+
+	r := &Record{}
+	if err := json.Unmarshal(metadata, &r.Metadata); err != nil {
+		return nil, err
+	}
+	r.Data = append([]byte{}, tx.Bucket(dataBucket).Get(key)...)
+	if v := tx.Bucket(attachmentBucket).Get(key); v != nil {
+		r.Attachment = append([]byte{}, v...)
+	}
+	return r, nil
+}
+
+// txScan returns a scanFunc for the index within a transaction
+func txScan(tx *bolt.Tx) scanFunc {
+	return func(prefix, start []byte, fn func(string, time.Time) (bool, error)) error {
+		c := tx.Bucket(indexBucket).Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			txID, receivedAt, err := parseIndexKey(prefix, k)
+			if err != nil {
+				return err
+			}
+			more, err := fn(txID, receivedAt)
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// txMetadata returns a metadata lookup within a transaction
+func txMetadata(tx *bolt.Tx) func(string) (*Metadata, error) {
+	return func(txID string) (*Metadata, error) {
+		v := tx.Bucket(metadataBucket).Get([]byte(txID))
+		if v == nil {
+			return nil, fmt.Errorf("index refers to missing record %q", txID)
+		}
+		m := &Metadata{}
+		return m, json.Unmarshal(v, m)
+	}
+}
+
+// put writes a record and its index keys within a transaction
+func put(tx *bolt.Tx, r *Record) error {
+	key := []byte(r.TxID)
+
+	metadata, err := json.Marshal(&r.Metadata)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(metadataBucket).Put(key, metadata); err != nil {
+		return err
+	}
+	if err = tx.Bucket(dataBucket).Put(key, r.Data); err != nil {
+		return err
+	}
+	if len(r.Attachment) > 0 {
+		if err = tx.Bucket(attachmentBucket).Put(key, r.Attachment); err != nil {
+			return err
+		}
+	}
+	return putIndex(tx, &r.Metadata)
+}
+
+// remove deletes a record and its index keys within a transaction
+func remove(tx *bolt.Tx, key []byte) error {
+	stored, err := get(tx, key)
+	if err != nil {
+		return err
+	}
+	for _, k := range indexKeys(&stored.Metadata) {
+		if err = tx.Bucket(indexBucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	for _, b := range [][]byte{metadataBucket, dataBucket, attachmentBucket} {
+		if err = tx.Bucket(b).Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putIndex adds a record's index keys within a transaction
+func putIndex(tx *bolt.Tx, m *Metadata) error {
+	b := tx.Bucket(indexBucket)
+	for _, key := range indexKeys(m) {
+		if err := b.Put(key, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
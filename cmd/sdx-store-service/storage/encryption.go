@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Algorithm is the encryption used for both data keys and record content
+const Algorithm = "A256GCM"
+
+// dataKeySize is the size of a record's data key - AES-256
+const dataKeySize = 32
+
+var (
+	// ErrUnknownKey is returned when a record was encrypted with a master
+	// key that isn't loaded
+	ErrUnknownKey = errors.New("unknown master key")
+
+	// ErrDecrypt is returned when a record can't be decrypted, e.g. because
+	// it has been tampered with
+	ErrDecrypt = errors.New("unable to decrypt record")
+)
+
+// Encryption describes how a record's content is encrypted. Each record has
+// its own data key, which is stored wrapped (encrypted) by a master key.
+type Encryption struct {
+	Algorithm  string `json:"alg"`
+	KeyID      string `json:"kid"`         // ID of the master key that wrapped the data key
+	WrappedKey []byte `json:"wrapped_key"` // Nonce followed by the sealed data key
+}
+
+// MasterKeys are the keys data keys are wrapped with. New records use the
+// current key - the others are kept so older records can be read until they
+// have been re-encrypted.
+type MasterKeys struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// masterKeysFile is the JSON file master keys are loaded from, e.g.
+//
+//	{"current": "2017q4", "keys": {"2017q3": "<base64>", "2017q4": "<base64>"}}
+//
+// where each key is 32 random bytes, base64 encoded
+type masterKeysFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LoadMasterKeys loads master keys from a JSON file
+func LoadMasterKeys(path string) (*MasterKeys, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f masterKeysFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse master keys: %w", err)
+	}
+
+	mk := &MasterKeys{current: f.Current, keys: make(map[string]cipher.AEAD, len(f.Keys))}
+	for id, encoded := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("master key %q must be %d bytes, base64 encoded", id, dataKeySize)
+		}
+		if mk.keys[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := mk.keys[mk.current]; !ok {
+		return nil, fmt.Errorf("current master key %q is not one of the keys", mk.current)
+	}
+	return mk, nil
+}
+
+// Current is the ID of the key new records are encrypted with
+func (mk *MasterKeys) Current() string {
+	return mk.current
+}
+
+// Encrypted wraps a store so that record content (but not metadata, which
+// is needed for searching) is encrypted before it is stored and decrypted
+// when it is read. Records stored before encryption was turned on are read
+// as they are.
+func Encrypted(s Store, keys *MasterKeys) Store {
+	return &encryptedStore{Store: s, keys: keys}
+}
+
+type encryptedStore struct {
+	Store
+	keys *MasterKeys
+}
+
+func (s *encryptedStore) Put(r *Record) error {
+	if err := prepare(r); err != nil {
+		return err
+	}
+
+	sealed, err := s.keys.seal(r)
+	if err != nil {
+		return err
+	}
+	err = s.Store.Put(sealed)
+	if err == ErrConflict {
+		// Each put is sealed with a new data key, so the underlying store
+		// can't tell a replay from a conflict - compare the plaintext
+		stored, getErr := s.Get(r.TxID)
+		if getErr != nil {
+			return getErr
+		}
+		if !sameContent(stored, r) {
+			return ErrConflict
+		}
+		r.Metadata = stored.Metadata
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.Metadata = sealed.Metadata
+	return nil
+}
+
+func (s *encryptedStore) Get(txID string) (*Record, error) {
+	r, err := s.Store.Get(txID)
+	if err != nil {
+		return nil, err
+	}
+	return s.keys.open(r)
+}
+
+func (s *encryptedStore) Replace(r *Record) error {
+	sealed, err := s.keys.seal(r)
+	if err != nil {
+		return err
+	}
+	return s.Store.Replace(sealed)
+}
+
+// Reencrypt brings every record in a store up to date with the current
+// master key. Records encrypted with an older key have their data key
+// rewrapped, and records stored before encryption was turned on are
+// encrypted. It works on the underlying store, not one returned by
+// Encrypted. Each record is passed to progress once it is done. Returns the
+// number of records changed.
+func Reencrypt(s Store, keys *MasterKeys, progress func(*Metadata)) (int, error) {
+	count := 0
+	q := Query{Limit: MaxLimit}
+	for {
+		page, err := s.List(q)
+		if err != nil {
+			return count, err
+		}
+
+		for i := range page.Records {
+			m := &page.Records[i]
+			if m.Encryption != nil && m.Encryption.KeyID == keys.current {
+				continue
+			}
+
+			r, err := s.Get(m.TxID)
+			if err != nil {
+				return count, err
+			}
+			if r.Encryption == nil {
+				r, err = keys.seal(r)
+			} else {
+				err = keys.rewrap(r)
+			}
+			if err != nil {
+				return count, fmt.Errorf("failed to re-encrypt %s: %w", m.TxID, err)
+			}
+			if err = s.Replace(r); err != nil {
+				return count, err
+			}
+
+			count++
+			if progress != nil {
+				progress(&r.Metadata)
+			}
+		}
+
+		if len(page.Next) == 0 {
+			return count, nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// seal returns a copy of a record with its content encrypted with a new data
+// key, wrapped by the current master key
+func (mk *MasterKeys) seal(r *Record) (*Record, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := &Record{Metadata: r.Metadata}
+	sealed.Size = len(r.Data)
+	sealed.AttachmentSize = len(r.Attachment)
+	sealed.Encryption = &Encryption{Algorithm: Algorithm, KeyID: mk.current}
+	if sealed.Encryption.WrappedKey, err = sealAEAD(mk.keys[mk.current], dataKey, []byte(r.TxID)); err != nil {
+		return nil, err
+	}
+	if sealed.Data, err = sealAEAD(aead, r.Data, []byte(r.TxID)); err != nil {
+		return nil, err
+	}
+	if len(r.Attachment) > 0 {
+		if sealed.Attachment, err = sealAEAD(aead, r.Attachment, []byte(r.TxID+"/"+attachmentFile)); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// open returns a copy of a record with its content decrypted
+func (mk *MasterKeys) open(r *Record) (*Record, error) {
+	if r.Encryption == nil {
+		return r, nil
+	}
+
+	dataKey, err := mk.unwrap(r)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	opened := &Record{Metadata: r.Metadata}
+	if opened.Data, err = openAEAD(aead, r.Data, []byte(r.TxID)); err != nil {
+		return nil, fmt.Errorf("%w %s", ErrDecrypt, r.TxID)
+	}
+	if len(r.Attachment) > 0 {
+		if opened.Attachment, err = openAEAD(aead, r.Attachment, []byte(r.TxID+"/"+attachmentFile)); err != nil {
+			return nil, fmt.Errorf("%w %s", ErrDecrypt, r.TxID)
+		}
+	}
+	return opened, nil
+}
+
+// rewrap rewraps an encrypted record's data key with the current master key
+func (mk *MasterKeys) rewrap(r *Record) error {
+	dataKey, err := mk.unwrap(r)
+	if err != nil {
+		return err
+	}
+	e := *r.Encryption
+	e.KeyID = mk.current
+	if e.WrappedKey, err = sealAEAD(mk.keys[mk.current], dataKey, []byte(r.TxID)); err != nil {
+		return err
+	}
+	r.Encryption = &e
+	return nil
+}
+
+// unwrap gets the data key of an encrypted record
+func (mk *MasterKeys) unwrap(r *Record) ([]byte, error) {
+	if r.Encryption.Algorithm != Algorithm {
+		return nil, fmt.Errorf("%w %s: unsupported algorithm %q", ErrDecrypt, r.TxID, r.Encryption.Algorithm)
+	}
+	master, ok := mk.keys[r.Encryption.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q for %s", ErrUnknownKey, r.Encryption.KeyID, r.TxID)
+	}
+	dataKey, err := openAEAD(master, r.Encryption.WrappedKey, []byte(r.TxID))
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: data key doesn't unwrap", ErrDecrypt, r.TxID)
+	}
+	return dataKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD encrypts with a random nonce, which is prepended to the result.
+// The additional data binds the ciphertext to the record it belongs to.
+func sealAEAD(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func openAEAD(aead cipher.AEAD, ciphertext, additional []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], additional)
+}
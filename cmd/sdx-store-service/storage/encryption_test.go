@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeMasterKeys writes a master keys file with the given current key and
+// returns the loaded keys
+func writeMasterKeys(t *testing.T, dir, current string, ids ...string) *MasterKeys {
+	keys := "{"
+	for i, id := range ids {
+		if i > 0 {
+			keys += ","
+		}
+		keys += fmt.Sprintf(`"%s": "%s"`, id, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[len(id)-1:]), dataKeySize)))
+	}
+	keys += "}"
+
+	path := filepath.Join(dir, "master-keys.json")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(`{"current": "%s", "keys": %s}`, current, keys)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mk, err := LoadMasterKeys(path)
+	if err != nil {
+		t.Fatalf("Expected master keys to load, got %v", err)
+	}
+	return mk
+}
+
+func TestEncrypted(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() Store) {
+		dir, err := ioutil.TempDir("", "keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		raw := open()
+		defer raw.Close()
+
+		// Stored before encryption was turned on
+		legacy := &Record{Metadata: Metadata{TxID: "legacy"}, Data: []byte(`{"a":0}`)}
+		if err = raw.Put(legacy); err != nil {
+			t.Fatal(err)
+		}
+
+		s := Encrypted(raw, writeMasterKeys(t, dir, "k1", "k1"))
+		plaintext := []byte(`{"a":1}`)
+		attachment := []byte("a,b\n1,2\n")
+		if err = s.Put(&Record{Metadata: Metadata{TxID: "abc"}, Data: plaintext, Attachment: attachment}); err != nil {
+			t.Fatalf("Expected put to succeed, got %v", err)
+		}
+
+		stored, err := raw.Get("abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(stored.Data, plaintext) || bytes.Contains(stored.Attachment, attachment) {
+			t.Error("Expected the content to be stored encrypted")
+		}
+		if stored.Encryption == nil || stored.Encryption.KeyID != "k1" || stored.Size != len(plaintext) {
+			t.Errorf("Expected the key ID and plaintext size to be recorded, got %+v", stored.Metadata)
+		}
+
+		for txID, expected := range map[string][]byte{"abc": plaintext, "legacy": legacy.Data} {
+			r, err := s.Get(txID)
+			if err != nil || !bytes.Equal(r.Data, expected) {
+				t.Errorf("Expected %s to read back as %q, got %q %v", txID, expected, r.Data, err)
+			}
+		}
+
+		if err = s.Put(&Record{Metadata: Metadata{TxID: "abc"}, Data: plaintext, Attachment: attachment}); err != nil {
+			t.Errorf("Expected the same record to be accepted again, got %v", err)
+		}
+		if err = s.Put(&Record{Metadata: Metadata{TxID: "abc"}, Data: []byte(`{"a":2}`)}); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict for a different record, got %v", err)
+		}
+
+		// Rotate to a new master key and re-encrypt everything
+		rotated := writeMasterKeys(t, dir, "k2", "k1", "k2")
+		count, err := Reencrypt(raw, rotated, nil)
+		if err != nil || count != 2 {
+			t.Fatalf("Expected 2 records re-encrypted, got %d %v", count, err)
+		}
+		if count, _ = Reencrypt(raw, rotated, nil); count != 0 {
+			t.Errorf("Expected nothing left to re-encrypt, got %d", count)
+		}
+
+		// The old key is no longer needed
+		s = Encrypted(raw, writeMasterKeys(t, dir, "k2", "k2"))
+		for txID, expected := range map[string][]byte{"abc": plaintext, "legacy": legacy.Data} {
+			r, err := s.Get(txID)
+			if err != nil || !bytes.Equal(r.Data, expected) || r.Encryption.KeyID != "k2" {
+				t.Errorf("Expected %s to read back as %q with k2, got %q %v", txID, expected, r.Data, err)
+			}
+		}
+		if r, err := s.Get("abc"); err != nil || !bytes.Equal(r.Attachment, attachment) {
+			t.Errorf("Expected the attachment to read back, got %q %v", r.Attachment, err)
+		}
+
+		// Tampering is detected
+		stored, _ = raw.Get("abc")
+		stored.Data[len(stored.Data)-1] ^= 1
+		if err = raw.Replace(stored); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.Get("abc"); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Expected ErrDecrypt for tampered content, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Files making up a record in the filesystem store
+const (
+	metadataFile   = "metadata.json"
+	dataFile       = "data"
+	attachmentFile = "attachment"
+)
+
+// Prefixes of directories that aren't records. None can start a tx_id.
+const (
+	tmpPrefix     = ".tmp-"
+	oldPrefix     = ".old-"
+	deletedPrefix = ".deleted-"
+)
+
+// filesystemStore keeps each record in its own directory:
+//
+//	<dir>/<tx_id>/metadata.json
+//	<dir>/<tx_id>/data
+//	<dir>/<tx_id>/attachment
+//
+// A record is written to a temporary directory, synced, then renamed into
+// place, so a record directory is only ever seen complete.
+//
+// The secondary indexes are kept in memory, built from the records' metadata
+// when the store is opened.
+type filesystemStore struct {
+	dir string
+	idx memoryIndex
+
+	// mu serialises writes so two puts for the same tx_id can't race
+	mu sync.Mutex
+}
+
+func openFilesystem(dir string) (*filesystemStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &filesystemStore{dir: dir}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err = s.recover(entry.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	if entries, err = ioutil.ReadDir(dir); err != nil {
+		return nil, err
+	}
+	records := make([]*Metadata, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		m, err := s.metadata(entry.Name())
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, m)
+	}
+	s.idx.load(records)
+	return s, nil
+}
+
+// recover tidies up after a put, replace or delete that didn't finish. A
+// temporary or deleted directory is removed. A replaced record is put back
+// if its replacement never made it into place, otherwise removed.
+func (s *filesystemStore) recover(name string) error {
+	switch {
+	case strings.HasPrefix(name, tmpPrefix), strings.HasPrefix(name, deletedPrefix):
+		return os.RemoveAll(filepath.Join(s.dir, name))
+	case strings.HasPrefix(name, oldPrefix):
+		old := filepath.Join(s.dir, name)
+		current := s.path(strings.TrimPrefix(name, oldPrefix))
+		if _, err := os.Stat(current); os.IsNotExist(err) {
+			return os.Rename(old, current)
+		}
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+func (s *filesystemStore) Put(r *Record) error {
+	if err := prepare(r); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.Get(r.TxID)
+	if err == nil {
+		if !sameContent(stored, r) {
+			return ErrConflict
+		}
+		r.Metadata = stored.Metadata
+		return nil
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	if err = assignRevision(r, s.idx.scan, s.metadata); err != nil {
+		return err
+	}
+
+	tmp, err := s.write(r)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err = os.Rename(tmp, s.path(r.TxID)); err != nil {
+		return err
+	}
+	if err = syncDir(s.dir); err != nil {
+		return err
+	}
+	s.idx.add(&r.Metadata)
+	return nil
+}
+
+// Replace moves the existing record aside, moves the new one into place and
+// then removes the old one. If that is interrupted, the next open puts
+// things right.
+func (s *filesystemStore) Replace(r *Record) error {
+	if err := prepare(r); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.metadata(r.TxID)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := s.write(r)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	old := filepath.Join(s.dir, oldPrefix+r.TxID)
+	if err = os.Rename(s.path(r.TxID), old); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path(r.TxID)); err != nil {
+		// Put the old one back rather than leave nothing there
+		os.Rename(old, s.path(r.TxID))
+		return err
+	}
+	if err = syncDir(s.dir); err != nil {
+		return err
+	}
+
+	s.idx.remove(stored)
+	s.idx.add(&r.Metadata)
+	return os.RemoveAll(old)
+}
+
+// Delete moves the record aside, which is what makes it gone, then removes
+// it
+func (s *filesystemStore) Delete(txID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.metadata(txID)
+	if err != nil {
+		return err
+	}
+
+	deleted := filepath.Join(s.dir, deletedPrefix+txID)
+	if err = os.Rename(s.path(txID), deleted); err != nil {
+		return err
+	}
+	if err = syncDir(s.dir); err != nil {
+		return err
+	}
+	s.idx.remove(stored)
+	return os.RemoveAll(deleted)
+}
+
+// write writes a record to a new temporary directory, synced to disk, and
+// returns the directory
+func (s *filesystemStore) write(r *Record) (string, error) {
+	tmp, err := ioutil.TempDir(s.dir, tmpPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := json.Marshal(&r.Metadata)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	files := map[string][]byte{metadataFile: metadata, dataFile: r.Data}
+	if len(r.Attachment) > 0 {
+		files[attachmentFile] = r.Attachment
+	}
+	for name, content := range files {
+		if err = writeFileSync(filepath.Join(tmp, name), content); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+	if err = syncDir(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+func (s *filesystemStore) Get(txID string) (*Record, error) {
+	m, err := s.metadata(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Record{Metadata: *m}
+	dir := s.path(txID)
+	if r.Data, err = ioutil.ReadFile(filepath.Join(dir, dataFile)); err != nil {
+		return nil, err
+	}
+	if r.AttachmentSize > 0 {
+		if r.Attachment, err = ioutil.ReadFile(filepath.Join(dir, attachmentFile)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (s *filesystemStore) List(q Query) (*Page, error) {
+	return list(q, s.idx.scan, s.metadata)
+}
+
+func (s *filesystemStore) Count(q Query) (int, error) {
+	return count(q, s.idx.scan, s.metadata)
+}
+
+// metadata reads just the metadata of a record
+func (s *filesystemStore) metadata(txID string) (*Metadata, error) {
+	if !ValidTxID(txID) {
+		return nil, ErrNotFound
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.path(txID), metadataFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *filesystemStore) Close() error {
+	return nil
+}
+
+func (s *filesystemStore) path(txID string) string {
+	return filepath.Join(s.dir, txID)
+}
+
+// writeFileSync writes a file and syncs it to disk
+func writeFileSync(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir syncs a directory so that entries created in it are durable
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
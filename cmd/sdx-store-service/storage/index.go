@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the number of records returned by List
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// ErrInvalidCursor is returned by List for a cursor it didn't hand out
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Query selects stored records. Empty fields match anything. Records come
+// back in the order they were received.
+type Query struct {
+	SurveyID     string
+	InstrumentID string
+	Period       string
+	ExerciseSID  string
+	Origin       string
+	Lineage      string // Every revision of a submission - see Metadata.Lineage
+
+	ReceivedFrom time.Time // Inclusive
+	ReceivedTo   time.Time // Exclusive
+
+	Cursor string // From a previous Page, to carry on after it
+	Limit  int    // Defaults to DefaultLimit, at most MaxLimit
+}
+
+// Page is a page of records matching a query
+type Page struct {
+	Records []Metadata
+
+	// Cursor to pass in the query for the next page. Empty if this is the
+	// last page.
+	Next string
+}
+
+// Each record has a key in the received index and one in the index for each
+// field it has a value for. A key is
+//
+//	<index> 0x00 [<value> 0x00] <received_at> 0x00 <tx_id>
+//
+// so that the keys for any one index value are in the order received, and a
+// query can scan from a given time (or cursor) within them.
+const (
+	receivedIndex = "received"
+	keySep        = "\x00"
+
+	// receivedFormat sorts as the time does
+	receivedFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+// indexedField is a field that has an index
+type indexedField struct {
+	name  string
+	value func(*Metadata) string
+	query func(*Query) string
+}
+
+// indexedFields in the order they are preferred for a query - the earlier
+// ones are expected to narrow the records down the most
+var indexedFields = []indexedField{
+	{lineageIndex, func(m *Metadata) string { return m.Lineage() }, func(q *Query) string { return q.Lineage }},
+	{"exercise_sid", func(m *Metadata) string { return m.ExerciseSID }, func(q *Query) string { return q.ExerciseSID }},
+	{"instrument_id", func(m *Metadata) string { return m.InstrumentID }, func(q *Query) string { return q.InstrumentID }},
+	{"period", func(m *Metadata) string { return m.Period }, func(q *Query) string { return q.Period }},
+	{"survey_id", func(m *Metadata) string { return m.SurveyID }, func(q *Query) string { return q.SurveyID }},
+	{"origin", func(m *Metadata) string { return m.Origin }, func(q *Query) string { return q.Origin }},
+}
+
+// position is where a record sits within any index
+func position(m *Metadata) string {
+	return m.ReceivedAt.UTC().Format(receivedFormat) + keySep + m.TxID
+}
+
+// indexable reports whether a value can go in an index key
+func indexable(v string) bool {
+	return len(v) > 0 && !strings.Contains(v, keySep)
+}
+
+// indexKeys returns every index key for a record
+func indexKeys(m *Metadata) [][]byte {
+	pos := position(m)
+	keys := [][]byte{[]byte(receivedIndex + keySep + pos)}
+	for _, f := range indexedFields {
+		if v := f.value(m); indexable(v) {
+			keys = append(keys, []byte(f.name+keySep+v+keySep+pos))
+		}
+	}
+	return keys
+}
+
+// matches reports whether a record matches a query's field filters
+func (q *Query) matches(m *Metadata) bool {
+	for _, f := range indexedFields {
+		if v := f.query(q); len(v) > 0 && v != f.value(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// scanFunc calls fn with the tx_id and received_at of each record in an
+// index with the given prefix, from the first key at or after start, until
+// fn returns false
+type scanFunc func(prefix, start []byte, fn func(txID string, receivedAt time.Time) (bool, error)) error
+
+// scanRange returns the index prefix a query scans and the key to start
+// from, ignoring any cursor, and whether every record under the prefix
+// matches the query's field filters without checking its metadata
+func (q *Query) scanRange() (prefix, start string, covered bool) {
+	prefix = receivedIndex + keySep
+	filters := 0
+	for _, f := range indexedFields {
+		if v := f.query(q); len(v) > 0 {
+			filters++
+			if prefix == receivedIndex+keySep && indexable(v) {
+				prefix = f.name + keySep + v + keySep
+				covered = true
+			}
+		}
+	}
+	covered = filters == 0 || (filters == 1 && covered)
+
+	start = prefix
+	if !q.ReceivedFrom.IsZero() {
+		start += q.ReceivedFrom.UTC().Format(receivedFormat)
+	}
+	return prefix, start, covered
+}
+
+// list runs a query with a backend's index scan and metadata lookup
+func list(q Query, scan scanFunc, metadata func(txID string) (*Metadata, error)) (*Page, error) {
+	if q.Limit < 1 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+
+	prefix, start, _ := q.scanRange()
+	if len(q.Cursor) > 0 {
+		after, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || !strings.Contains(string(after), keySep) {
+			return nil, ErrInvalidCursor
+		}
+		// The smallest key after the cursor's
+		if cursor := prefix + string(after) + keySep; cursor > start {
+			start = cursor
+		}
+	}
+
+	page := &Page{Records: []Metadata{}}
+	err := scan([]byte(prefix), []byte(start), func(txID string, receivedAt time.Time) (bool, error) {
+		if !q.ReceivedTo.IsZero() && !receivedAt.Before(q.ReceivedTo) {
+			return false, nil
+		}
+		m, err := metadata(txID)
+		if err != nil {
+			return false, err
+		}
+		if !q.matches(m) {
+			return true, nil
+		}
+		if len(page.Records) == q.Limit {
+			last := &page.Records[len(page.Records)-1]
+			page.Next = base64.RawURLEncoding.EncodeToString([]byte(position(last)))
+			return false, nil
+		}
+		page.Records = append(page.Records, *m)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// parseIndexKey gets the tx_id and received_at from an index key
+func parseIndexKey(prefix, key []byte) (string, time.Time, error) {
+	parts := bytes.SplitN(key[len(prefix):], []byte(keySep), 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, fmt.Errorf("malformed index key %q", key)
+	}
+	receivedAt, err := time.Parse(receivedFormat, string(parts[0]))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed index key %q: %w", key, err)
+	}
+	return string(parts[1]), receivedAt, nil
+}
+
+// memoryIndex is a sorted set of index keys held in memory, for backends
+// that don't have anywhere better to keep them
+type memoryIndex struct {
+	mu   sync.RWMutex
+	keys []string
+}
+
+// scanBatch is how many keys memoryIndex.scan copies out at a time. The lock
+// isn't held while they are handed on, as that usually means reading from
+// disk.
+const scanBatch = 256
+
+// load replaces the index with one for the given records. The keys are
+// sorted once, rather than each being inserted in turn.
+func (idx *memoryIndex) load(ms []*Metadata) {
+	keys := make([]string, 0, len(ms)*(len(indexedFields)+1))
+	for _, m := range ms {
+		for _, key := range indexKeys(m) {
+			keys = append(keys, string(key))
+		}
+	}
+	// Every key ends with its record's tx_id, so there are no duplicates
+	sort.Strings(keys)
+
+	idx.mu.Lock()
+	idx.keys = keys
+	idx.mu.Unlock()
+}
+
+func (idx *memoryIndex) add(m *Metadata) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, key := range indexKeys(m) {
+		k := string(key)
+		i := sort.SearchStrings(idx.keys, k)
+		if i < len(idx.keys) && idx.keys[i] == k {
+			continue
+		}
+		idx.keys = append(idx.keys, "")
+		copy(idx.keys[i+1:], idx.keys[i:])
+		idx.keys[i] = k
+	}
+}
+
+func (idx *memoryIndex) remove(m *Metadata) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, key := range indexKeys(m) {
+		k := string(key)
+		i := sort.SearchStrings(idx.keys, k)
+		if i < len(idx.keys) && idx.keys[i] == k {
+			idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+		}
+	}
+}
+
+func (idx *memoryIndex) scan(prefix, start []byte, fn func(string, time.Time) (bool, error)) error {
+	from := string(start)
+	for {
+		batch := idx.keysFrom(string(prefix), from, scanBatch)
+		for _, key := range batch {
+			txID, receivedAt, err := parseIndexKey(prefix, []byte(key))
+			if err != nil {
+				return err
+			}
+			more, err := fn(txID, receivedAt)
+			if err != nil || !more {
+				return err
+			}
+		}
+		if len(batch) < scanBatch {
+			return nil
+		}
+		// The smallest key after the last one
+		from = batch[len(batch)-1] + keySep
+	}
+}
+
+// keysFrom copies out up to n keys with the given prefix, from the first at
+// or after from
+func (idx *memoryIndex) keysFrom(prefix, from string, n int) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var keys []string
+	for i := sort.SearchStrings(idx.keys, from); i < len(idx.keys) && len(keys) < n && strings.HasPrefix(idx.keys[i], prefix); i++ {
+		keys = append(keys, idx.keys[i])
+	}
+	return keys
+}
+
+// count counts the records matching a query, ignoring its cursor and limit.
+// Metadata is only read when the index scanned doesn't cover every filter.
+func count(q Query, scan scanFunc, metadata func(txID string) (*Metadata, error)) (int, error) {
+	prefix, start, covered := q.scanRange()
+
+	n := 0
+	err := scan([]byte(prefix), []byte(start), func(txID string, receivedAt time.Time) (bool, error) {
+		if !q.ReceivedTo.IsZero() && !receivedAt.Before(q.ReceivedTo) {
+			return false, nil
+		}
+		if !covered {
+			m, err := metadata(txID)
+			if err != nil {
+				return false, err
+			}
+			if !q.matches(m) {
+				return true, nil
+			}
+		}
+		n++
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
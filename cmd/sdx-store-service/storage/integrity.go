@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Outcomes of verifying a record
+const (
+	Intact   = "intact"   // The content matches its hash
+	Corrupt  = "corrupt"  // The content doesn't match its hash, or can't be read
+	Unhashed = "unhashed" // Stored before hashes were, so can't be checked
+)
+
+// Hash is the hex SHA-256 of some content, as recorded in Metadata
+func Hash(b []byte) string {
+	digest := sha256.Sum256(b)
+	return hex.EncodeToString(digest[:])
+}
+
+// Verification is the result of checking a record against its hash
+type Verification struct {
+	TxID     string `json:"tx_id"`
+	Status   string `json:"status"`
+	SHA256   string `json:"sha256,omitempty"`   // As recorded when it was stored
+	Computed string `json:"computed,omitempty"` // Of the content as it is now
+	Detail   string `json:"detail,omitempty"`
+}
+
+// Verify re-reads a record and checks its content against the hashes taken
+// when it was stored. A record that can no longer be decrypted is corrupt.
+// Returns an error only if the record can't be checked at all, e.g.
+// ErrNotFound.
+func Verify(s Store, txID string) (*Verification, error) {
+	r, err := s.Get(txID)
+	if errors.Is(err, ErrDecrypt) {
+		return &Verification{TxID: txID, Status: Corrupt, Detail: err.Error()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verification{TxID: txID, SHA256: r.SHA256, Computed: Hash(r.Data)}
+	switch {
+	case len(r.SHA256) == 0:
+		v.Status = Unhashed
+	case v.Computed != r.SHA256:
+		v.Status = Corrupt
+		v.Detail = "content doesn't match its hash"
+	case len(r.AttachmentSHA256) > 0 && Hash(r.Attachment) != r.AttachmentSHA256:
+		v.Status = Corrupt
+		v.Detail = "attachment doesn't match its hash"
+	default:
+		v.Status = Intact
+	}
+	return v, nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// lineageIndex is the index of every revision of a submission
+const lineageIndex = "lineage"
+
+// Lineage identifies a submission across resubmissions - a respondent
+// submitting again for the same ru_ref, survey, instrument and period. It is
+// empty for a record without all four, which has no lineage.
+func (m *Metadata) Lineage() string {
+	if len(m.RuRef) == 0 || len(m.SurveyID) == 0 || len(m.InstrumentID) == 0 || len(m.Period) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal([]string{m.RuRef, m.SurveyID, m.InstrumentID, m.Period})
+	return string(b)
+}
+
+// assignRevision sets a new record's revision to one more than the latest
+// already stored in its lineage. It must be called with the backend locked
+// for writing, so that revisions go up in the order records are stored.
+func assignRevision(r *Record, scan scanFunc, metadata func(txID string) (*Metadata, error)) error {
+	r.Revision = 1
+
+	lineage := r.Lineage()
+	if !indexable(lineage) {
+		return nil
+	}
+	prefix := []byte(lineageIndex + keySep + lineage + keySep)
+	return scan(prefix, prefix, func(txID string, _ time.Time) (bool, error) {
+		m, err := metadata(txID)
+		if err != nil {
+			return false, err
+		}
+		if m.Revision >= r.Revision {
+			r.Revision = m.Revision + 1
+		}
+		return true, nil
+	})
+}
+
+// History returns the metadata of every revision of the submission a record
+// belongs to, oldest revision first. A record with no lineage is its own
+// history.
+func History(s Store, txID string) ([]Metadata, error) {
+	r, err := s.Get(txID)
+	if err != nil {
+		return nil, err
+	}
+	lineage := r.Lineage()
+	if !indexable(lineage) {
+		return []Metadata{r.Metadata}, nil
+	}
+
+	var revisions []Metadata
+	q := Query{Lineage: lineage, Limit: MaxLimit}
+	for {
+		page, err := s.List(q)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, page.Records...)
+		if len(page.Next) == 0 {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	sort.SliceStable(revisions, func(i, j int) bool { return revisions[i].Revision < revisions[j].Revision })
+	return revisions, nil
+}
@@ -0,0 +1,159 @@
+// Package storage is where the store service keeps what it is sent. The
+// store is the system of record, so every implementation must have written a
+// record durably (synced to disk) before Put returns.
+//
+// Records are keyed by tx_id. Putting the same record twice (e.g. when the
+// gateway retries after a timeout) is fine, but a different record with a
+// tx_id that's already stored is refused.
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Backends that can be passed to Open
+const (
+	Filesystem = "filesystem"
+	Bolt       = "bolt"
+)
+
+// Kinds of record
+const (
+	KindSurvey = "survey"
+	KindSEFT   = "seft"
+)
+
+var (
+	// ErrNotFound is returned when there is no record for a tx_id
+	ErrNotFound = errors.New("record not found")
+
+	// ErrConflict is returned when a different record is already stored with
+	// the same tx_id
+	ErrConflict = errors.New("a different record is already stored with this tx_id")
+
+	// ErrInvalidTxID is returned for a tx_id that can't be used as a key
+	ErrInvalidTxID = errors.New("invalid tx_id")
+)
+
+// txIDPattern is what a tx_id must look like to be used as a key. It keeps
+// tx_ids safe to use as file names.
+var txIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,127}$`)
+
+// Metadata describes a stored record
+type Metadata struct {
+	TxID         string    `json:"tx_id"`
+	Kind         string    `json:"kind"`
+	ReceivedAt   time.Time `json:"received_at"`
+	ContentType  string    `json:"content_type"`
+	Size         int       `json:"size"`
+	SurveyID     string    `json:"survey_id,omitempty"`
+	InstrumentID string    `json:"instrument_id,omitempty"`
+	Period       string    `json:"period,omitempty"`
+	ExerciseSID  string    `json:"exercise_sid,omitempty"`
+	Origin       string    `json:"origin,omitempty"`
+	RuRef        string    `json:"ru_ref,omitempty"`
+
+	// Hex SHA-256 of the content as it was received, to check it against
+	SHA256           string `json:"sha256,omitempty"`
+	AttachmentSHA256 string `json:"attachment_sha256,omitempty"`
+
+	// Revision of the submission - see Lineage. Starts at 1 and goes up by
+	// one for each resubmission.
+	Revision int `json:"revision,omitempty"`
+
+	// Set for a record with an attachment (SEFT)
+	AttachmentName string `json:"attachment_name,omitempty"`
+	AttachmentType string `json:"attachment_type,omitempty"`
+	AttachmentSize int    `json:"attachment_size,omitempty"`
+
+	// Set for a record whose content is encrypted. The sizes are always of
+	// the plaintext.
+	Encryption *Encryption `json:"encryption,omitempty"`
+}
+
+// Record is a stored survey or SEFT return
+type Record struct {
+	Metadata
+	Data       []byte // Exactly as posted - survey JSON or SEFT metadata
+	Attachment []byte // The SEFT file, if any
+}
+
+// Store keeps records. Implementations are safe for concurrent use.
+type Store interface {
+	// Put durably stores a record, giving it the next revision in its
+	// lineage. If the same record is already stored its Metadata is replaced
+	// with the stored one (so ReceivedAt is the time it was first stored) and
+	// nil returned.
+	Put(r *Record) error
+
+	// Get returns the record for a tx_id, or ErrNotFound
+	Get(txID string) (*Record, error)
+
+	// List returns a page of the metadata of records matching a query
+	List(q Query) (*Page, error)
+
+	// Count returns how many records match a query, ignoring its cursor
+	// and limit
+	Count(q Query) (int, error)
+
+	// Replace durably overwrites a stored record, e.g. to re-encrypt it,
+	// or returns ErrNotFound if there isn't one
+	Replace(r *Record) error
+
+	// Delete removes a stored record, or returns ErrNotFound if there isn't
+	// one
+	Delete(txID string) error
+
+	Close() error
+}
+
+// Open opens (creating if needed) a store with the given backend. Path is a
+// directory for the filesystem backend and a file for bolt.
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case Filesystem:
+		return openFilesystem(path)
+	case Bolt:
+		return openBolt(path)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q - expected %q or %q", backend, Filesystem, Bolt)
+}
+
+// ValidTxID reports whether a tx_id can be used as a key
+func ValidTxID(txID string) bool {
+	return txIDPattern.MatchString(txID)
+}
+
+// prepare checks a record before it is stored, filling in what can be
+// derived from it
+func prepare(r *Record) error {
+	if !ValidTxID(r.TxID) {
+		return fmt.Errorf("%w: %q", ErrInvalidTxID, r.TxID)
+	}
+	if r.ReceivedAt.IsZero() {
+		r.ReceivedAt = time.Now().UTC()
+	}
+	if r.Encryption == nil {
+		r.Size = len(r.Data)
+		r.AttachmentSize = len(r.Attachment)
+
+		// Hashed once, as received - a replacement keeps the original hashes
+		if len(r.SHA256) == 0 {
+			r.SHA256 = Hash(r.Data)
+			if len(r.Attachment) > 0 {
+				r.AttachmentSHA256 = Hash(r.Attachment)
+			}
+		}
+	}
+	return nil
+}
+
+// sameContent reports whether a stored record holds the same content as a
+// new one
+func sameContent(stored, r *Record) bool {
+	return bytes.Equal(stored.Data, r.Data) && bytes.Equal(stored.Attachment, r.Attachment)
+}
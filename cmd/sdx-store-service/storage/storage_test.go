@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// eachBackend runs a test against a fresh store for every backend. open
+// reopens the same store.
+func eachBackend(t *testing.T, test func(t *testing.T, open func() Store)) {
+	for _, backend := range []string{Filesystem, Bolt} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "storage")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "records")
+			test(t, func() Store {
+				s, err := Open(backend, path)
+				if err != nil {
+					t.Fatalf("Expected store to open, got %v", err)
+				}
+				return s
+			})
+		})
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() Store) {
+		s := open()
+
+		r := &Record{
+			Metadata: Metadata{TxID: "0f534ffc-9442-414c-b39f-a756b4adc6cb", Kind: KindSEFT, SurveyID: "023"},
+			Data:     []byte(`{"tx_id":"0f534ffc-9442-414c-b39f-a756b4adc6cb"}`),
+		}
+		r.Attachment = []byte("a,b\n1,2\n")
+		if err := s.Put(r); err != nil {
+			t.Fatalf("Expected put to succeed, got %v", err)
+		}
+		if r.ReceivedAt.IsZero() || r.Size != len(r.Data) {
+			t.Errorf("Expected received_at and size to be set, got %+v", r.Metadata)
+		}
+
+		// Survives a restart
+		s.Close()
+		s = open()
+		defer s.Close()
+
+		got, err := s.Get(r.TxID)
+		if err != nil {
+			t.Fatalf("Expected get to succeed, got %v", err)
+		}
+		if !bytes.Equal(got.Data, r.Data) || !bytes.Equal(got.Attachment, r.Attachment) ||
+			got.SurveyID != "023" || !got.ReceivedAt.Equal(r.ReceivedAt) {
+			t.Errorf("Expected %+v, got %+v", r, got)
+		}
+
+		if _, err = s.Get("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestPutReplay(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() Store) {
+		s := open()
+		defer s.Close()
+
+		first := &Record{Metadata: Metadata{TxID: "abc"}, Data: []byte(`{"a":1}`)}
+		if err := s.Put(first); err != nil {
+			t.Fatal(err)
+		}
+
+		same := &Record{Metadata: Metadata{TxID: "abc"}, Data: []byte(`{"a":1}`)}
+		if err := s.Put(same); err != nil {
+			t.Errorf("Expected the same record to be accepted again, got %v", err)
+		}
+		if !same.ReceivedAt.Equal(first.ReceivedAt) {
+			t.Error("Expected the originally stored metadata for a replay")
+		}
+
+		different := &Record{Metadata: Metadata{TxID: "abc"}, Data: []byte(`{"a":2}`)}
+		if err := s.Put(different); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict for a different record, got %v", err)
+		}
+
+		if err := s.Put(&Record{Metadata: Metadata{TxID: "../abc"}}); !errors.Is(err, ErrInvalidTxID) {
+			t.Errorf("Expected ErrInvalidTxID, got %v", err)
+		}
+	})
+}
+
+func TestList(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() Store) {
+		s := open()
+
+		start := time.Date(2017, 10, 1, 9, 0, 0, 0, time.UTC)
+		for i, m := range []Metadata{
+			{TxID: "a", SurveyID: "023", InstrumentID: "0203", Period: "201710"},
+			{TxID: "b", SurveyID: "023", InstrumentID: "0203", Period: "201709"},
+			{TxID: "c", SurveyID: "023", InstrumentID: "0203", Period: "201710", Origin: "eq"},
+			{TxID: "d", SurveyID: "139", InstrumentID: "0001", Period: "201710"},
+			{TxID: "e", SurveyID: "023", InstrumentID: "0203", Period: "201710"},
+		} {
+			m.ReceivedAt = start.Add(time.Duration(i) * time.Minute)
+			if err := s.Put(&Record{Metadata: m, Data: []byte(m.TxID)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Indexes are rebuilt or persisted across a restart
+		s.Close()
+		s = open()
+		defer s.Close()
+
+		txIDs := func(q Query) (ids string, next string) {
+			page, err := s.List(q)
+			if err != nil {
+				t.Fatalf("Expected list to succeed, got %v", err)
+			}
+			for _, m := range page.Records {
+				ids += m.TxID
+			}
+			return ids, page.Next
+		}
+
+		for expected, q := range map[string]Query{
+			"abcde": {},
+			"ace":   {SurveyID: "023", InstrumentID: "0203", Period: "201710"},
+			"c":     {Period: "201710", Origin: "eq"},
+			"bc":    {SurveyID: "023", ReceivedFrom: start.Add(time.Minute), ReceivedTo: start.Add(3 * time.Minute)},
+			"":      {SurveyID: "999"},
+		} {
+			if got, next := txIDs(q); got != expected || len(next) > 0 {
+				t.Errorf("Expected %q for %+v, got %q (next %q)", expected, q, got, next)
+			}
+			q.Limit = 1
+			if n, err := s.Count(q); err != nil || n != len(expected) {
+				t.Errorf("Expected a count of %d for %+v, got %d (%v)", len(expected), q, n, err)
+			}
+		}
+
+		// Paging through with a cursor
+		var all string
+		q := Query{Period: "201710", Limit: 2}
+		for i := 0; i < 3; i++ {
+			got, next := txIDs(q)
+			all += got
+			if len(next) == 0 {
+				break
+			}
+			q.Cursor = next
+		}
+		if all != "acde" {
+			t.Errorf("Expected to page through acde, got %q", all)
+		}
+
+		if _, err := s.List(Query{Cursor: "!"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("Expected ErrInvalidCursor, got %v", err)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() Store) {
+		s := open()
+
+		for _, txID := range []string{"a", "b"} {
+			if err := s.Put(&Record{Metadata: Metadata{TxID: txID, SurveyID: "144"}, Data: []byte(txID)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Delete("a"); err != nil {
+			t.Fatalf("Expected delete to succeed, got %v", err)
+		}
+		if err := s.Delete("a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound deleting again, got %v", err)
+		}
+
+		// Gone from the indexes too, and stays gone
+		s.Close()
+		s = open()
+		defer s.Close()
+
+		if _, err := s.Get("a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		page, err := s.List(Query{SurveyID: "144"})
+		if err != nil || len(page.Records) != 1 || page.Records[0].TxID != "b" {
+			t.Errorf("Expected only b to be listed, got %+v %v", page, err)
+		}
+	})
+}
+
+func TestRevisions(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() Store) {
+		s := open()
+
+		put := func(txID, ruRef string) *Record {
+			r := &Record{
+				Metadata: Metadata{TxID: txID, RuRef: ruRef, SurveyID: "009", InstrumentID: "0203", Period: "201710"},
+				Data:     []byte(txID),
+			}
+			if err := s.Put(r); err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+
+		for i, txID := range []string{"first", "second", "third"} {
+			if r := put(txID, "12345678901A"); r.Revision != i+1 {
+				t.Errorf("Expected %s to be revision %d, got %d", txID, i+1, r.Revision)
+			}
+		}
+		if r := put("other", "99999999999Z"); r.Revision != 1 {
+			t.Errorf("Expected another reporting unit to start at revision 1, got %d", r.Revision)
+		}
+		if r := put("second", "12345678901A"); r.Revision != 2 {
+			t.Errorf("Expected a replay to keep its revision, got %d", r.Revision)
+		}
+
+		s.Close()
+		s = open()
+		defer s.Close()
+
+		if r := put("fourth", "12345678901A"); r.Revision != 4 {
+			t.Errorf("Expected revision 4 after a restart, got %d", r.Revision)
+		}
+
+		history, err := History(s, "second")
+		if err != nil {
+			t.Fatalf("Expected history, got %v", err)
+		}
+		var got string
+		for _, m := range history {
+			got += fmt.Sprintf("%s:%d ", m.TxID, m.Revision)
+		}
+		if got != "first:1 second:2 third:3 fourth:4 " {
+			t.Errorf("Expected the revisions in order, got %q", got)
+		}
+
+		if err = s.Put(&Record{Metadata: Metadata{TxID: "alone"}, Data: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		if history, err = History(s, "alone"); err != nil || len(history) != 1 || history[0].Revision != 1 {
+			t.Errorf("Expected a record without a lineage to be its own history, got %+v %v", history, err)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() Store) {
+		s := open()
+		defer s.Close()
+
+		r := &Record{Metadata: Metadata{TxID: "abc"}, Data: []byte(`{"a":1}`), Attachment: []byte("a,b")}
+		if err := s.Put(r); err != nil {
+			t.Fatal(err)
+		}
+		if r.SHA256 != Hash([]byte(`{"a":1}`)) || len(r.AttachmentSHA256) == 0 {
+			t.Errorf("Expected the content to be hashed, got %+v", r.Metadata)
+		}
+
+		if v, err := Verify(s, "abc"); err != nil || v.Status != Intact {
+			t.Errorf("Expected an intact record, got %+v %v", v, err)
+		}
+
+		// Corrupt the attachment behind the hash's back
+		stored, _ := s.Get("abc")
+		stored.Attachment = []byte("a,c")
+		if err := s.Replace(stored); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := Verify(s, "abc"); err != nil || v.Status != Corrupt {
+			t.Errorf("Expected a corrupt record, got %+v %v", v, err)
+		}
+
+		if _, err := Verify(s, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestMemoryIndex(t *testing.T) {
+	start := time.Date(2017, 10, 1, 9, 0, 0, 0, time.UTC)
+	var records []*Metadata
+	for i := 0; i < 2*scanBatch+10; i++ {
+		records = append(records, &Metadata{TxID: fmt.Sprintf("tx-%04d", i), SurveyID: "023", ReceivedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	// Loaded in any order
+	records[0], records[len(records)-1] = records[len(records)-1], records[0]
+
+	var idx memoryIndex
+	idx.load(records)
+
+	done := make(chan error)
+	var scanned []string
+	go func() {
+		prefix := []byte("survey_id" + keySep + "023" + keySep)
+		done <- idx.scan(prefix, prefix, func(txID string, receivedAt time.Time) (bool, error) {
+			// The index can be written to while a scan is handing out keys
+			if len(scanned) == 0 {
+				idx.add(&Metadata{TxID: "new", SurveyID: "139", ReceivedAt: start})
+			}
+			scanned = append(scanned, txID)
+			return true, nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the index not to be locked while scanning")
+	}
+
+	if len(scanned) != len(records) {
+		t.Fatalf("Expected %d records scanned, got %d", len(records), len(scanned))
+	}
+	for i, txID := range scanned {
+		if expected := fmt.Sprintf("tx-%04d", i); txID != expected {
+			t.Fatalf("Expected %s at %d, got %s", expected, i, txID)
+		}
+	}
+}
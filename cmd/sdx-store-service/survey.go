@@ -4,8 +4,34 @@ package main
 // processed by this service. It only attempts to map the common core elements
 // that should always be present no matter the survey type.
 type Survey struct {
-	TxID     string `json:"tx_id"`
-	Type     string `json:"type"`
-	Origin   string `json:"origin"`
-	SurveyID string `json:"survey_id"`
+	TxID       string     `json:"tx_id"`
+	Type       string     `json:"type"`
+	Origin     string     `json:"origin"`
+	SurveyID   string     `json:"survey_id"`
+	Collection Collection `json:"collection"`
+	Metadata   Metadata   `json:"metadata"`
+}
+
+// Collection represents the collection part of a block of survey data
+type Collection struct {
+	ExerciseSID  string `json:"exercise_sid"`
+	InstrumentID string `json:"instrument_id"`
+	Period       string `json:"period"`
+}
+
+// Metadata represents the metadata part of a block of survey data
+type Metadata struct {
+	UserID string `json:"user_id"`
+	RuRef  string `json:"ru_ref"`
+}
+
+// SEFTMetadata represents the key elements of the metadata posted with a
+// SEFT return
+type SEFTMetadata struct {
+	TxID         string `json:"tx_id"`
+	SurveyID     string `json:"survey_id"`
+	InstrumentID string `json:"instrument_id"`
+	Period       string `json:"period"`
+	RuRef        string `json:"ru_ref"`
+	ExerciseSID  string `json:"exercise_sid,omitempty"`
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/outbox"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+// PendingOutboxHandler lists the notifications in the outbox that have not
+// yet been published.
+func PendingOutboxHandler(rw http.ResponseWriter, r *http.Request) {
+	entries, err := notifyOutbox.Pending()
+	if err != nil {
+		log.Printf(`event="Failed to list outbox" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to list outbox",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Count   int            `json:"count"`
+		Pending []outbox.Entry `json:"pending"`
+	}{len(entries), entries})
+	if err != nil {
+		log.Printf(`event="Failed to marshal outbox" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to list outbox",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
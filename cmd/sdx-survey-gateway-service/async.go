@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/jobs"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
+)
+
+// asyncRetryBackoff is the delay before the first retry of a failed
+// asynchronous submission - doubled for each retry after that
+const asyncRetryBackoff = time.Second * 2
+
+var (
+	// asyncJobs is only set when running in asynchronous mode
+	asyncJobs *jobs.Queue
+)
+
+// acceptSurveyAsync is the asynchronous alternative to processSubmission.
+// Once the posted data has been checked it is persisted as is and the client
+// given a 202 pointing at the status resource, with the store and notify
+// work done in the background.
+func acceptSurveyAsync(ctx context.Context, rw http.ResponseWriter, data []byte) {
+	txID, status, problem := queueSurvey(ctx, data)
+	if problem != nil {
+		api.WriteProblemResponse(*problem, rw)
+		return
+	}
+	if status == http.StatusAccepted {
+		writeAccepted(rw, txID)
+		return
+	}
+	rw.WriteHeader(status)
+}
+
+// queueSurvey checks posted survey data and queues it to be processed in the
+// background. It returns the tx_id along with a 202 once it's queued (or
+// already was), the original status for a replay of a finished submission,
+// or the problem to report.
+func queueSurvey(ctx context.Context, data []byte) (string, int, *api.Problem) {
+
+	// Decrypting, parsing and validating don't rely on anything downstream
+	// so are still done up front - a bad submission gets told straight away
+	survey, body, problem := parseSubmission(data)
+	if problem == nil {
+		problem = checkOrigin(ctx, survey)
+	}
+	if problem != nil {
+		return "", 0, problem
+	}
+
+	hash, previous, problem := claimSubmission(survey, body)
+	if problem != nil {
+		return survey.TxID, 0, problem
+	}
+	if previous != nil {
+		if previous.Hash == hash && previous.Status == 0 {
+			// Already accepted and still being worked on
+			return survey.TxID, http.StatusAccepted, nil
+		}
+		status, problem := replayResult(survey, hash, previous)
+		return survey.TxID, status, problem
+	}
+
+	// Queue the survey JSON as it was accepted, so that a key or schema
+	// change while it waits can't fail it
+	err := asyncJobs.Enqueue(survey.TxID, body)
+	if errors.Is(err, jobs.ErrExists) {
+		// Our claim lapsed while an earlier submission was still queued. The
+		// claim is left in place - the queued job will complete it.
+		log.Printf(`event="Replay of tx_id still queued" tx_id="%s"`, survey.TxID)
+		return survey.TxID, 0, &api.Problem{
+			Title:  "Submission in progress",
+			Status: http.StatusConflict,
+			Detail: "A submission with this tx_id is still being processed - retry later",
+		}
+	}
+	if err != nil {
+		log.Printf(`event="Failed to queue survey" tx_id="%s" error="%v"`, survey.TxID, err)
+		abandonTx(survey.TxID)
+		return survey.TxID, 0, &api.Problem{
+			Title:  "Unable to accept survey at this time",
+			Status: http.StatusInternalServerError,
+		}
+	}
+
+	// The job may be retried for longer than the claim lasts
+	if err = holdTx(survey.TxID, hash); err != nil {
+		log.Printf(`event="Failed to extend tx_id claim" tx_id="%s" error="%v"`, survey.TxID, err)
+	}
+
+	log.Printf(`event="Accepted survey for asynchronous processing" tx_id="%s"`, survey.TxID)
+	return survey.TxID, http.StatusAccepted, nil
+}
+
+func writeAccepted(rw http.ResponseWriter, txID string) {
+	rw.Header().Set("Location", fmt.Sprintf("/survey/%s/status", txID))
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// processJob is run by the background workers for each queued submission
+func processJob(j jobs.Job) error {
+	survey, body, problem := jobSubmission(j)
+	if problem != nil {
+		return errors.New(problem.Title)
+	}
+	survey.ReceivedAt = j.QueuedAt
+	if problem = deliverSubmission(context.Background(), survey, body); problem != nil {
+		return errors.New(problem.Title)
+	}
+	finishSubmission(survey, hashSurvey(body))
+	return nil
+}
+
+// jobSubmission gets the survey a job was queued for. A job holds the survey
+// JSON that was decrypted and validated when it was accepted, so it's only
+// parsed.
+func jobSubmission(j jobs.Job) (*Survey, []byte, *api.Problem) {
+	var survey Survey
+	if err := json.Unmarshal(j.Body, &survey); err != nil {
+		log.Printf(`event="Failed to parse queued survey JSON" tx_id="%s" error="%v"`, j.TxID, err)
+		return nil, nil, &api.Problem{
+			Title:  "Failed to parse survey JSON",
+			Status: http.StatusBadRequest,
+		}
+	}
+	return &survey, j.Body, nil
+}
+
+// failJob is called when a queued submission has run out of retries. The
+// tx_id is released so that the client can submit it again.
+func failJob(j jobs.Job) {
+	abandonTx(j.TxID)
+	stages.Record(j.TxID, tracker.Failed, j.LastError)
+}
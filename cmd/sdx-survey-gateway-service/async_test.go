@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/jobs"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/keyring"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/schema"
+	"github.com/ONSdigital/sdx-evolution/internal/redis"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// fakeTxRedis keeps the tx_id records in memory, answering just the
+// commands the idempotency checks use
+type fakeTxRedis struct {
+	values map[string]string
+	ttls   map[string]int64
+}
+
+func (f *fakeTxRedis) Close() error                      { return nil }
+func (f *fakeTxRedis) Err() error                        { return nil }
+func (f *fakeTxRedis) Flush() error                      { return nil }
+func (f *fakeTxRedis) Receive() (interface{}, error)     { return nil, errors.New("not supported") }
+func (f *fakeTxRedis) Send(string, ...interface{}) error { return errors.New("not supported") }
+func (f *fakeTxRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "":
+		return nil, nil
+	case "SET":
+		key := args[0].(string)
+		if _, ok := f.values[key]; ok && len(args) > 4 && args[4] == "nx" {
+			return nil, nil
+		}
+		f.values[key], f.ttls[key] = args[1].(string), args[3].(int64)
+		return "OK", nil
+	case "GET":
+		if v, ok := f.values[args[0].(string)]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "DEL":
+		delete(f.values, args[0].(string))
+		return int64(1), nil
+	}
+	return nil, errors.New("unexpected command " + cmd)
+}
+
+func TestQueueSurveyReplayAfterClaimLapses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if schemas, err = schema.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if asyncJobs, err = jobs.Open(filepath.Join(dir, "jobs.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { asyncJobs.Close(); asyncJobs = nil }()
+
+	f := &fakeTxRedis{values: map[string]string{}, ttls: map[string]int64{}}
+	redisPool = &redis.Pool{Dial: func() (redigo.Conn, error) { return f, nil }}
+	claimTTL, idempotencyWindow = 2*time.Minute, 24*time.Hour
+	defer func() { redisPool = nil }()
+
+	const txID = "0f534ffc-9442-414c-b39f-a756b4adc6cb"
+	keysDir := filepath.Join(dir, "keys")
+	submit := func(survey string) (int, string) {
+		token := eqToken(t, keysDir, []byte(survey))
+		if keys, err = keyring.Load(keysDir); err != nil {
+			t.Fatal(err)
+		}
+		_, status, problem := queueSurvey(context.Background(), []byte(token))
+		if problem != nil {
+			return problem.Status, problem.Title
+		}
+		return status, ""
+	}
+
+	first := `{"tx_id": "` + txID + `", "survey_id": "023", "collection": {"instrument_id": "0203"}}`
+	if status, problem := submit(first); status != http.StatusAccepted {
+		t.Fatalf("Expected the submission to be accepted, got %d %s", status, problem)
+	}
+	if ttl := f.ttls[txKeyPrefix+txID]; ttl != int64(idempotencyWindow/time.Millisecond) {
+		t.Errorf("Expected the claim to be held for the idempotency window once queued, got %dms", ttl)
+	}
+
+	// Even if the claim lapses while the job is retried, a different
+	// submission with the same tx_id can't replace it
+	delete(f.values, txKeyPrefix+txID)
+	second := strings.Replace(first, `"0203"`, `"0213"`, 1)
+	if status, problem := submit(second); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a replay of a queued tx_id, got %d %s", status, problem)
+	}
+	if err = asyncJobs.Enqueue(txID, []byte(second)); !errors.Is(err, jobs.ErrExists) {
+		t.Errorf("Expected the queued job to be kept, got %v", err)
+	}
+}
+
+func TestJobSubmission(t *testing.T) {
+	// No keys or schemas are loaded - a queued job was decrypted and
+	// validated when it was accepted, and mustn't depend on them again
+	body := []byte(`{"tx_id": "0f534ffc-9442-414c-b39f-a756b4adc6cb", "survey_id": "023", "collection": {"instrument_id": "0203"}}`)
+	survey, got, problem := jobSubmission(jobs.Job{TxID: "0f534ffc-9442-414c-b39f-a756b4adc6cb", Body: body, QueuedAt: time.Now()})
+	if problem != nil {
+		t.Fatalf("Expected the queued survey to be used as it is, got %+v", *problem)
+	}
+	if survey.TxID != "0f534ffc-9442-414c-b39f-a756b4adc6cb" || survey.SurveyID != "023" || string(got) != string(body) {
+		t.Errorf("Unexpected survey %+v", survey)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/origins"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+// allowedOrigins is only set when ORIGINS_FILE is configured. Without it
+// any caller may submit.
+var allowedOrigins *origins.Registry
+
+type originKey struct{}
+
+// requireOrigin wraps a submission handler so that it only runs for a
+// request from a known origin that is within its rate limit. The origin is
+// passed on in the request context.
+func requireOrigin(next http.Handler) http.Handler {
+	return originHandler(next, true)
+}
+
+// requireBatchOrigin is requireOrigin for a batch of submissions. The batch is
+// charged to the rate limit per submission once it has been read (see
+// allowBatch) rather than as a single request.
+func requireBatchOrigin(next http.Handler) http.Handler {
+	return originHandler(next, false)
+}
+
+// requireKnownOrigin wraps a handler that reads rather than submits, e.g. a
+// submission's status, so that it only runs for a request from a known
+// origin. It isn't charged to the rate limit.
+func requireKnownOrigin(next http.Handler) http.Handler {
+	return originHandler(next, false)
+}
+
+func originHandler(next http.Handler, limit bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if allowedOrigins == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		origin, err := allowedOrigins.Authenticate(r)
+		if err != nil {
+			log.Printf(`event="Rejected request - not authenticated" path="%s" remote_addr="%s" error="%v"`, r.URL.Path, r.RemoteAddr, err)
+			challenge := `Bearer realm="sdx"`
+			if errors.Is(err, origins.ErrBadCredentials) {
+				challenge += `, error="invalid_token"`
+			}
+			rw.Header().Set("WWW-Authenticate", challenge)
+			api.WriteProblemResponse(api.Problem{
+				Title:  "Unauthorized",
+				Status: http.StatusUnauthorized,
+				Detail: "A bearer token or client certificate for a known origin is required",
+			}, rw)
+			return
+		}
+
+		if limit {
+			if ok, wait := origin.Allow(); !ok {
+				writeRateLimited(rw, r, origin, wait)
+				return
+			}
+		}
+
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), originKey{}, origin)))
+	})
+}
+
+// allowBatch charges a batch of n submissions to the rate limit of the origin
+// that sent it, so that batching them up isn't a way around the limit. If the
+// origin can't cover the whole batch it is rejected and false returned.
+func allowBatch(rw http.ResponseWriter, r *http.Request, n int) bool {
+	origin, ok := r.Context().Value(originKey{}).(*origins.Origin)
+	if !ok {
+		return true
+	}
+
+	ok, wait := origin.AllowN(n)
+	if ok {
+		return true
+	}
+	if wait == 0 {
+		log.Printf(`event="Rejected request - batch over burst" origin="%s" path="%s" items="%d"`, origin.Name, r.URL.Path, n)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Too many submissions",
+			Status: http.StatusRequestEntityTooLarge,
+			Detail: fmt.Sprintf("Origin %q may not submit %d surveys at once", origin.Name, n),
+		}, rw)
+		return false
+	}
+	writeRateLimited(rw, r, origin, wait)
+	return false
+}
+
+// writeRateLimited tells an origin that's over its rate limit when to retry
+func writeRateLimited(rw http.ResponseWriter, r *http.Request, origin *origins.Origin, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	log.Printf(`event="Rejected request - rate limited" origin="%s" path="%s" retry_after="%d"`, origin.Name, r.URL.Path, retryAfter)
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	api.WriteProblemResponse(api.Problem{
+		Title:  "Too many requests",
+		Status: http.StatusTooManyRequests,
+		Detail: fmt.Sprintf("Origin %q is over its rate limit - retry after %d second(s)", origin.Name, retryAfter),
+	}, rw)
+}
+
+// checkOrigin makes sure a survey claims to come from the origin that
+// submitted it. It returns nil when origins aren't configured.
+func checkOrigin(ctx context.Context, survey *Survey) *api.Problem {
+	origin, ok := ctx.Value(originKey{}).(*origins.Origin)
+	if !ok || survey.Origin == origin.Name {
+		return nil
+	}
+	log.Printf(`event="Survey origin does not match caller" tx_id="%s" origin="%s" caller="%s"`, survey.TxID, survey.Origin, origin.Name)
+	return &api.Problem{
+		Title:  "Forbidden",
+		Status: http.StatusForbidden,
+		Detail: fmt.Sprintf("Origin %q may not submit surveys for origin %q", origin.Name, survey.Origin),
+	}
+}
+
+// listenAndServe starts the webserver for the given handler, over TLS if a
+// certificate is configured. If a client CA is also given, client certificates are
+// requested and verified against it so that origins can authenticate with
+// them.
+func listenAndServe(addr string, handler http.Handler, certFile, keyFile, clientCAFile string) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if len(certFile) == 0 {
+		return srv.ListenAndServe()
+	}
+
+	if len(clientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/origins"
+)
+
+func TestRequireOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "origins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	digest := sha256.Sum256([]byte("s3cret"))
+	path := filepath.Join(dir, "origins.json")
+	config := fmt.Sprintf(`[{"name": "eq", "token_sha256": "%s", "rate": 0.001, "burst": 1}]`, hex.EncodeToString(digest[:]))
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if allowedOrigins, err = origins.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { allowedOrigins = nil }()
+
+	var origin string
+	handler := requireOrigin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if problem := checkOrigin(r.Context(), &Survey{Origin: "other"}); problem != nil {
+			origin = "forbidden"
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("POST", "/survey", nil))
+	if rw.Code != http.StatusUnauthorized || len(rw.Header().Get("WWW-Authenticate")) == 0 {
+		t.Errorf("Expected 401 with a challenge without a token, got %d", rw.Code)
+	}
+
+	r := httptest.NewRequest("POST", "/survey", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 with a token, got %d", rw.Code)
+	}
+	if origin != "forbidden" {
+		t.Error("Expected a survey from another origin to be forbidden")
+	}
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	if rw.Code != http.StatusTooManyRequests || len(rw.Header().Get("Retry-After")) == 0 {
+		t.Errorf("Expected 429 with Retry-After once over the limit, got %d", rw.Code)
+	}
+
+	// Reads need credentials too, but aren't rate limited
+	read := requireKnownOrigin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	rw = httptest.NewRecorder()
+	read.ServeHTTP(rw, httptest.NewRequest("GET", "/survey/abc/status", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a status without a token, got %d", rw.Code)
+	}
+	r = httptest.NewRequest("GET", "/survey/abc/status", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	rw = httptest.NewRecorder()
+	read.ServeHTTP(rw, r)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a status with a token once over the limit, got %d", rw.Code)
+	}
+}
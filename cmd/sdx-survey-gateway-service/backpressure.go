@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/backpressure"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+var (
+	// pressure tells us when the pipeline can't take any more
+	pressure *backpressure.Monitor
+
+	// shedRetryAfter is how long clients are told to wait when turned away
+	shedRetryAfter time.Duration
+)
+
+// shedLoad wraps a submission handler so that it turns requests away with a
+// 503 while the pipeline is overloaded, leaving the client to retry later.
+func shedLoad(next http.Handler) http.Handler {
+	return shedLoadExcept(next, func(*http.Request) bool { return false })
+}
+
+// shedLoadUnlessDryRun is shedLoad for a handler that honours dry_run. Dry
+// runs publish nothing so are never turned away.
+func shedLoadUnlessDryRun(next http.Handler) http.Handler {
+	return shedLoadExcept(next, isDryRun)
+}
+
+// overloaded reports whether the pipeline can't take any more, and why
+var overloaded = func() (bool, string) {
+	return pressure.Overloaded()
+}
+
+// shedLoadExcept sheds load for every request that isn't exempt
+func shedLoadExcept(next http.Handler, exempt func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if exempt(r) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if over, reason := overloaded(); over {
+			retryAfter := int(math.Ceil(shedRetryAfter.Seconds()))
+			log.Printf(`event="Shedding request - pipeline overloaded" path="%s" reason="%s"`, r.URL.Path, reason)
+			rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			api.WriteProblemResponse(api.Problem{
+				Title:  "Unable to accept survey at this time",
+				Status: http.StatusServiceUnavailable,
+				Detail: "The pipeline is overloaded - retry later",
+			}, rw)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,165 @@
+// Package backpressure tells the gateway when to stop taking submissions
+// because the pipeline behind it can't keep up.
+//
+// It watches the broker's flow control notifications (connection.blocked,
+// sent when RabbitMQ hits a memory or disk alarm) and optionally polls the
+// depth of a queue, e.g. the legacy router's work queue. While either is
+// over its threshold the gateway should turn submissions away with a 503 so
+// that clients retry later, rather than piling more onto the broker.
+package backpressure
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Metrics published at /debug/vars
+var (
+	metrics = expvar.NewMap("backpressure")
+	blocked = new(expvar.Int)
+	depth   = new(expvar.Int)
+	shed    = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("blocked", blocked)
+	metrics.Set("queue_depth", depth)
+	metrics.Set("shed", shed)
+}
+
+// Options controls what is watched
+type Options struct {
+	Queue    string        // Queue to poll the depth of. Empty means don't.
+	MaxDepth int           // Messages on Queue above which we're overloaded
+	Interval time.Duration // How often to poll Queue
+}
+
+// Monitor tracks whether the pipeline is overloaded. It is safe for
+// concurrent use.
+type Monitor struct {
+	opts Options
+
+	mu            sync.RWMutex
+	blockedReason string // Set while the broker has blocked the connection
+	queueDepth    int    // Last polled depth, -1 if unknown
+}
+
+// Start begins watching the given connection for flow control
+// notifications, until it closes. See PollQueue for the queue depth.
+func Start(conn *amqp.Connection, opts Options) *Monitor {
+	m := &Monitor{opts: opts, queueDepth: -1}
+	go m.watchBlocked(conn.NotifyBlocked(make(chan amqp.Blocking, 1)))
+	return m
+}
+
+// PollQueue starts polling the depth of the configured queue, if there is
+// one. Returns a cancel function to stop polling.
+func (m *Monitor) PollQueue(conn *amqp.Connection) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	if len(m.opts.Queue) == 0 {
+		return cancel
+	}
+
+	log.Printf(`event="Starting queue depth polling" queue="%s" max_depth="%d" interval="%s"`, m.opts.Queue, m.opts.MaxDepth, m.opts.Interval)
+
+	go func(ctx context.Context) {
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+
+		var ch *amqp.Channel
+		defer func() {
+			if ch != nil {
+				ch.Close()
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Print(`event="Canceling queue depth polling"`)
+				return
+			case <-ticker.C:
+			}
+
+			var err error
+			if ch == nil {
+				if ch, err = conn.Channel(); err != nil {
+					log.Printf(`event="Failed to open channel for queue depth" error="%v"`, err)
+					ch = nil
+					m.setDepth(-1)
+					continue
+				}
+			}
+
+			// A passive declare fails (and closes the channel) if the queue
+			// doesn't exist yet, rather than creating it
+			q, err := ch.QueueDeclarePassive(m.opts.Queue, true, false, false, false, nil)
+			if err != nil {
+				log.Printf(`event="Failed to get queue depth" queue="%s" error="%v"`, m.opts.Queue, err)
+				ch.Close()
+				ch = nil
+				m.setDepth(-1)
+				continue
+			}
+			m.setDepth(q.Messages)
+		}
+	}(ctx)
+
+	return cancel
+}
+
+// watchBlocked follows the broker's flow control notifications until the
+// connection closes
+func (m *Monitor) watchBlocked(blockings <-chan amqp.Blocking) {
+	for b := range blockings {
+		m.mu.Lock()
+		if b.Active {
+			log.Printf(`event="Broker has blocked publishing" reason="%s"`, b.Reason)
+			m.blockedReason = b.Reason
+			if len(m.blockedReason) == 0 {
+				m.blockedReason = "unknown"
+			}
+			blocked.Set(1)
+		} else {
+			log.Print(`event="Broker has unblocked publishing"`)
+			m.blockedReason = ""
+			blocked.Set(0)
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Monitor) setDepth(n int) {
+	m.mu.Lock()
+	m.queueDepth = n
+	m.mu.Unlock()
+	depth.Set(int64(n))
+}
+
+// Overloaded reports whether submissions should be turned away, and if so
+// why. Each time it returns true is counted as a shed request. An unknown
+// queue depth isn't treated as overloaded.
+func (m *Monitor) Overloaded() (bool, string) {
+	if m == nil {
+		return false, ""
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	switch {
+	case len(m.blockedReason) > 0:
+		shed.Add(1)
+		return true, fmt.Sprintf("broker is blocking publishers (%s)", m.blockedReason)
+	case len(m.opts.Queue) > 0 && m.queueDepth > m.opts.MaxDepth:
+		shed.Add(1)
+		return true, fmt.Sprintf("%d messages waiting on %s", m.queueDepth, m.opts.Queue)
+	}
+	return false, ""
+}
@@ -0,0 +1,54 @@
+package backpressure
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestOverloaded(t *testing.T) {
+	m := &Monitor{opts: Options{Queue: "sdx.survey.legacy.work", MaxDepth: 10}, queueDepth: -1}
+
+	if over, _ := m.Overloaded(); over {
+		t.Error("Expected not to be overloaded with an unknown queue depth")
+	}
+
+	m.setDepth(11)
+	if over, reason := m.Overloaded(); !over || len(reason) == 0 {
+		t.Error("Expected to be overloaded above the maximum depth")
+	}
+	m.setDepth(10)
+	if over, _ := m.Overloaded(); over {
+		t.Error("Expected not to be overloaded at the maximum depth")
+	}
+
+	blockings := make(chan amqp.Blocking)
+	done := make(chan struct{})
+	go func() {
+		m.watchBlocked(blockings)
+		close(done)
+	}()
+
+	blockings <- amqp.Blocking{Active: true, Reason: "low on memory"}
+	blockings <- amqp.Blocking{Active: true, Reason: "low on memory"} // Wait for the first to be handled
+	if over, _ := m.Overloaded(); !over {
+		t.Error("Expected to be overloaded while the broker is blocking")
+	}
+
+	blockings <- amqp.Blocking{Active: false}
+	close(blockings)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected watcher to stop when the notifications close")
+	}
+	if over, _ := m.Overloaded(); over {
+		t.Error("Expected not to be overloaded once the broker unblocks")
+	}
+
+	var nilMonitor *Monitor
+	if over, _ := nilMonitor.Overloaded(); over {
+		t.Error("Expected a nil monitor never to be overloaded")
+	}
+}
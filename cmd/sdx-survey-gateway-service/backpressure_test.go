@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShedLoadDryRun(t *testing.T) {
+	overloaded = func() (bool, string) { return true, "test" }
+	defer func() { overloaded = func() (bool, string) { return pressure.Overloaded() } }()
+
+	router := newRouter()
+	for path, contentType := range map[string]string{
+		"/surveys?dry_run=true": "application/x-ndjson",
+		"/seft?dry_run=true":    "multipart/form-data; boundary=x",
+		"/survey":               "application/jose",
+	} {
+		r := httptest.NewRequest("POST", path, strings.NewReader("a.b.c.d.e"))
+		r.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		if rw.Code != http.StatusServiceUnavailable || len(rw.Header().Get("Retry-After")) == 0 {
+			t.Errorf("Expected %s to be shed while overloaded, got %d", path, rw.Code)
+		}
+	}
+
+	// Only a dry run of a single survey is let through, as nothing is published
+	r := httptest.NewRequest("POST", "/survey?dry_run=true", strings.NewReader("a.b.c.d.e"))
+	r.Header.Set("Content-Type", "application/jose")
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, r)
+	if rw.Code == http.StatusServiceUnavailable {
+		t.Errorf("Expected a dry run not to be shed while overloaded, got %d", rw.Code)
+	}
+}
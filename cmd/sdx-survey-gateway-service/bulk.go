@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+const (
+	// bulkMaxItems is the most submissions we'll accept in one request
+	bulkMaxItems = 1000
+
+	// bulkWorkers is how many submissions from one request are processed
+	// at the same time
+	bulkWorkers = 4
+)
+
+// bulkResult is the outcome for a single submission in a bulk request
+type bulkResult struct {
+	Index   int          `json:"index"`
+	TxID    string       `json:"tx_id,omitempty"`
+	Status  int          `json:"status"`
+	Problem *api.Problem `json:"problem,omitempty"`
+}
+
+type bulkResponse struct {
+	Total    int          `json:"total"`
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Results  []bulkResult `json:"results"`
+}
+
+// submitFunc runs a single piece of posted survey data through the
+// pipeline, returning its tx_id and status or the problem to report
+type submitFunc func(ctx context.Context, data []byte) (string, int, *api.Problem)
+
+// BulkSurveysHandler takes a batch of posted survey data and runs each item
+// through the same pipeline as PostedSurveyHandler - including queuing it in
+// asynchronous mode. The body is either newline delimited
+// (application/x-ndjson) or a JSON array (application/json), where each item
+// is an encrypted survey token.
+//
+// The response is always a 200 with a result for every item, unless the
+// batch as a whole can't be read or is over the origin's rate limit.
+func BulkSurveysHandler(rw http.ResponseWriter, r *http.Request) {
+	submit := submitSurvey
+	if asyncJobs != nil {
+		submit = queueSurvey
+	}
+	bulkSubmit(rw, r, submit)
+}
+
+func bulkSubmit(rw http.ResponseWriter, r *http.Request, submit submitFunc) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf(`event="Failed to read posted data" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Request body unreadable",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	items, err := splitBulk(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		log.Printf(`event="Failed to split bulk submission" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to read submissions",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		}, rw)
+		return
+	}
+	if len(items) == 0 {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Request body empty",
+			Status: http.StatusBadRequest,
+		}, rw)
+		return
+	}
+	if len(items) > bulkMaxItems {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Too many submissions",
+			Status: http.StatusRequestEntityTooLarge,
+			Detail: fmt.Sprintf("A single request may contain at most %d submissions", bulkMaxItems),
+		}, rw)
+		return
+	}
+	if !allowBatch(rw, r, len(items)) {
+		return
+	}
+
+	log.Printf(`event="Received bulk submission" items="%d"`, len(items))
+
+	response := bulkResponse{
+		Total:   len(items),
+		Results: make([]bulkResult, len(items)),
+	}
+
+	// Work through the items with a few workers - each writes only to its
+	// own slot in the results
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < bulkWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				txID, status, problem := submit(r.Context(), items[i])
+				result := bulkResult{Index: i, TxID: txID, Status: status, Problem: problem}
+				if problem != nil {
+					result.Status = problem.Status
+				}
+				response.Results[i] = result
+			}
+		}()
+	}
+	for i := range items {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for _, result := range response.Results {
+		if result.Problem == nil {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+	}
+	log.Printf(`event="Processed bulk submission" accepted="%d" rejected="%d"`, response.Accepted, response.Rejected)
+
+	out, err := json.Marshal(&response)
+	if err != nil {
+		log.Printf(`event="Failed to marshal bulk response" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to build response",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(out)
+}
+
+// splitBulk breaks a bulk body into its individual submissions. A JSON
+// array must hold strings. Each NDJSON line may be a JSON string or the bare
+// token, and blank lines are ignored.
+func splitBulk(contentType string, body []byte) ([][]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	trimmed := bytes.TrimSpace(body)
+
+	// Accept a JSON array even if the client doesn't say so
+	if mediaType == "application/json" || bytes.HasPrefix(trimmed, []byte("[")) {
+		var tokens []string
+		if err := json.Unmarshal(trimmed, &tokens); err != nil {
+			return nil, fmt.Errorf("expected a JSON array of strings: %v", err)
+		}
+		items := make([][]byte, len(tokens))
+		for i, t := range tokens {
+			items[i] = []byte(t)
+		}
+		return items, nil
+	}
+
+	var items [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), len(trimmed)+1)
+	for line := 1; scanner.Scan(); line++ {
+		item := bytes.TrimSpace(scanner.Bytes())
+		if len(item) == 0 {
+			continue
+		}
+		if item[0] == '"' {
+			var token string
+			if err := json.Unmarshal(item, &token); err != nil {
+				return nil, fmt.Errorf("line %d is not a valid JSON string: %v", line, err)
+			}
+			item = []byte(token)
+		} else {
+			// The scanner reuses its buffer
+			item = append([]byte(nil), item...)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
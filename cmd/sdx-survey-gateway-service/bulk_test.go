@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/origins"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+// fakeSubmit stands in for the pipeline - items named "ok-<tx_id>" are
+// accepted with the given status, anything else is rejected
+func fakeSubmit(status int) submitFunc {
+	return func(ctx context.Context, data []byte) (string, int, *api.Problem) {
+		item := string(data)
+		if strings.HasPrefix(item, "ok-") {
+			return strings.TrimPrefix(item, "ok-"), status, nil
+		}
+		return "", 0, &api.Problem{Title: "Failed to decrypt survey data", Status: http.StatusBadRequest}
+	}
+}
+
+func bulkRequest(body string) *http.Request {
+	r := httptest.NewRequest("POST", "/surveys", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	return r
+}
+
+func TestBulkSubmit(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusAccepted} {
+		rw := httptest.NewRecorder()
+		bulkSubmit(rw, bulkRequest("ok-a\nnot.a.token\nok-b\n"), fakeSubmit(status))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d %s", rw.Code, rw.Body.String())
+		}
+
+		var response bulkResponse
+		if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Total != 3 || response.Accepted != 2 || response.Rejected != 1 {
+			t.Errorf("Expected 2 of 3 accepted, got %+v", response)
+		}
+		for i, expected := range []bulkResult{
+			{Index: 0, TxID: "a", Status: status},
+			{Index: 1, Status: http.StatusBadRequest},
+			{Index: 2, TxID: "b", Status: status},
+		} {
+			got := response.Results[i]
+			if got.Index != expected.Index || got.TxID != expected.TxID || got.Status != expected.Status || (got.Problem == nil) != (expected.Status != http.StatusBadRequest) {
+				t.Errorf("Expected result %+v, got %+v", expected, got)
+			}
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	bulkSubmit(rw, bulkRequest("\n\n"), fakeSubmit(http.StatusOK))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty batch, got %d", rw.Code)
+	}
+}
+
+func TestBulkSubmitRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "origins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	digest := sha256.Sum256([]byte("s3cret"))
+	path := filepath.Join(dir, "origins.json")
+	config := fmt.Sprintf(`[{"name": "eq", "token_sha256": "%s", "rate": 0.001, "burst": 3}]`, hex.EncodeToString(digest[:]))
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if allowedOrigins, err = origins.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { allowedOrigins = nil }()
+
+	handler := requireBatchOrigin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		bulkSubmit(rw, r, fakeSubmit(http.StatusOK))
+	}))
+	post := func(body string) *httptest.ResponseRecorder {
+		r := bulkRequest(body)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw
+	}
+
+	// More than the origin could ever send at once
+	if rw := post("ok-a\nok-b\nok-c\nok-d\n"); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a batch over the burst, got %d", rw.Code)
+	}
+
+	// Each item costs a token, so a batch of 2 leaves room for one more
+	if rw := post("ok-a\nok-b\n"); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a batch within the limit, got %d", rw.Code)
+	}
+	if rw := post("ok-c\nok-d\n"); rw.Code != http.StatusTooManyRequests || len(rw.Header().Get("Retry-After")) == 0 {
+		t.Errorf("Expected 429 with Retry-After once the batch is over the limit, got %d", rw.Code)
+	}
+}
+
+func TestSplitBulk(t *testing.T) {
+
+	// JSON array
+	items, err := splitBulk("application/json", []byte(`["a.b.c.d.e", "f.g.h.i.j"]`))
+	if err != nil || len(items) != 2 || string(items[1]) != "f.g.h.i.j" {
+		t.Errorf("Expected 2 items from JSON array, got %q (%v)", items, err)
+	}
+
+	// JSON array must hold strings
+	if _, err = splitBulk("application/json", []byte(`[{"tx_id":"1"}]`)); err == nil {
+		t.Error("Expected error for JSON array of objects")
+	}
+
+	// NDJSON with bare tokens, JSON strings and blank lines
+	items, err = splitBulk("application/x-ndjson", []byte("a.b.c.d.e\n\n\"f.g.h.i.j\"\r\nk.l.m.n.o\n"))
+	if err != nil || len(items) != 3 {
+		t.Fatalf("Expected 3 items from NDJSON, got %q (%v)", items, err)
+	}
+	if string(items[0]) != "a.b.c.d.e" || string(items[1]) != "f.g.h.i.j" || string(items[2]) != "k.l.m.n.o" {
+		t.Errorf("Unexpected NDJSON items %q", items)
+	}
+
+	// Empty
+	if items, _ = splitBulk("application/x-ndjson", []byte("\n\n")); len(items) != 0 {
+		t.Errorf("Expected no items from blank body, got %q", items)
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"log"
 	"os"
+	"strings"
 )
 
 // C holds the loaded configuration
@@ -14,13 +15,16 @@ func Load() {
 
 	// We know how many items we're going to have in the map
 	// so we can pre-declare the length as a compiler hint.
-	C = make(map[string]string, 4)
+	C = make(map[string]string, 34)
 
 	required := []string{
 		"PORT",
 		"STORE_URL",
 		"RABBIT_URL",
 		"NOTIFICATION_EXCHANGE",
+		"KEYS_DIR",
+		"SCHEMAS_DIR",
+		"REDIS_URL",
 	}
 
 	for _, r := range required {
@@ -28,5 +32,47 @@ func Load() {
 			log.Fatalf(`event="Failed to start - Must supply %s environment variable"`, r)
 		}
 	}
+
+	// Optional variables and their defaults
+	optional := map[string]string{
+		"ADMIN_PORT":               "5001",
+		"IDEMPOTENCY_WINDOW":       "24h",
+		"IDEMPOTENCY_CLAIM_TTL":    "2m",
+		"OUTBOX_PATH":              "outbox.db",
+		"OUTBOX_RELAY_INTERVAL":    "10s",
+		"RABBIT_PUBLISH_CHANNELS":  "8",
+		"ASYNC_SUBMISSIONS":        "false",
+		"ASYNC_QUEUE_PATH":         "jobs.db",
+		"ASYNC_WORKERS":            "4",
+		"ASYNC_MAX_ATTEMPTS":       "10",
+		"STORE_TIMEOUT":            "10s",
+		"STORE_ATTEMPT_TIMEOUT":    "3s",
+		"STORE_MAX_ATTEMPTS":       "3",
+		"CLOUDEVENTS_MODE":         "none",
+		"REJECT_UNKNOWN_SURVEYS":   "false",
+		"MAX_BODY_BYTES":           "1048576",
+		"BULK_MAX_BODY_BYTES":      "33554432",
+		"BACKPRESSURE_QUEUE":       "",
+		"BACKPRESSURE_MAX_DEPTH":   "10000",
+		"BACKPRESSURE_INTERVAL":    "5s",
+		"BACKPRESSURE_RETRY_AFTER": "30s",
+		"ORIGINS_FILE":             "",
+		"TLS_CERT_FILE":            "",
+		"TLS_KEY_FILE":             "",
+		"TLS_CLIENT_CA_FILE":       "",
+		"SEFT_MAX_BYTES":           "26214400",
+		"SEFT_CONTENT_TYPES": strings.Join([]string{
+			"application/vnd.ms-excel",
+			"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+			"application/vnd.oasis.opendocument.spreadsheet",
+			"text/csv",
+		}, ","),
+	}
+
+	for o, def := range optional {
+		if C[o] = os.Getenv(o); len(C[o]) == 0 {
+			C[o] = def
+		}
+	}
 	log.Println("CONFIG IS ", C)
 }
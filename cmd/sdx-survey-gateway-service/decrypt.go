@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/keyring"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+	"github.com/ONSdigital/sdx-evolution/internal/jose"
+)
+
+// eqSubmissionPurpose is the keyring purpose holding both the SDX private
+// keys that eQ encrypts to and the eQ public keys it signs with.
+const eqSubmissionPurpose = "eq-submission"
+
+var keys *keyring.Keyring
+
+// errNoKey is returned when the keyring has nothing matching a token's kid
+var errNoKey = errors.New("no matching key")
+
+// decryptSurvey unwraps posted survey data. The body is expected to be a
+// JWE (encrypted for SDX) which itself contains a JWS (signed by eQ) whose
+// payload is the survey JSON.
+func decryptSurvey(body []byte) ([]byte, error) {
+	jws, err := decrypt(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	payload, err := verify(string(jws))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify: %w", err)
+	}
+	return payload, nil
+}
+
+// decrypt tries each candidate private key for the token's kid. Tokens
+// without a kid are tried against every active key.
+func decrypt(token string) ([]byte, error) {
+	header, err := jose.ParseHeader(token)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := keys.PrivateKeys(eqSubmissionPurpose, header.KeyID)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: kid %q", errNoKey, header.KeyID)
+	}
+
+	for _, key := range candidates {
+		var plaintext []byte
+		if plaintext, _, err = jose.Decrypt(token, key); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
+}
+
+// verify tries each candidate public key for the token's kid. Tokens
+// without a kid are tried against every active key.
+func verify(token string) ([]byte, error) {
+	header, err := jose.ParseHeader(token)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := keys.PublicKeys(eqSubmissionPurpose, header.KeyID)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: kid %q", errNoKey, header.KeyID)
+	}
+
+	for _, key := range candidates {
+		var payload []byte
+		if payload, _, err = jose.Verify(token, key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, err
+}
+
+// decryptionProblem maps an error from decryptSurvey to the problem response
+// we want to give to the client.
+func decryptionProblem(err error) api.Problem {
+	switch {
+	case errors.Is(err, jose.ErrMalformed):
+		return api.Problem{
+			Title:  "Malformed survey token",
+			Status: http.StatusBadRequest,
+			Detail: "Expected a compact serialised JWE containing a JWS",
+		}
+	case errors.Is(err, jose.ErrUnsupportedAlgorithm):
+		return api.Problem{
+			Title:  "Unsupported token algorithm",
+			Status: http.StatusBadRequest,
+			Detail: "Expected RSA-OAEP/A256GCM encryption and RS256 signing",
+		}
+	case errors.Is(err, errNoKey):
+		return api.Problem{
+			Title:  "Unknown key ID",
+			Status: http.StatusBadRequest,
+			Detail: "The kid in the token header does not match an active key",
+		}
+	case errors.Is(err, jose.ErrDecryption):
+		return api.Problem{
+			Title:  "Failed to decrypt survey data",
+			Status: http.StatusBadRequest,
+		}
+	case errors.Is(err, jose.ErrSignature):
+		return api.Problem{
+			Title:  "Failed to verify survey signature",
+			Status: http.StatusUnauthorized,
+		}
+	}
+	log.Printf(`event="Unexpected decryption error" error="%v"`, err)
+	return api.Problem{
+		Title:  "Failed to decrypt survey data",
+		Status: http.StatusInternalServerError,
+	}
+}
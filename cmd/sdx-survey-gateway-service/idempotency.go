@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	redis "github.com/ONSdigital/sdx-evolution/internal/redis"
+)
+
+// txKeyPrefix namespaces the tx_id records the gateway keeps in redis
+const txKeyPrefix = "sdx_gateway_tx:"
+
+// claimAttempts is how many times claimTx tries to claim a tx_id whose record
+// keeps disappearing between checking for it and reading it
+const claimAttempts = 3
+
+var (
+	redisPool *redis.Pool
+
+	// idempotencyWindow is how long we remember a tx_id for. A retry from
+	// eQ after this window will be treated as a brand new submission.
+	idempotencyWindow time.Duration
+
+	// claimTTL is how long a tx_id is held as in progress. It only needs to
+	// cover processing a submission, so that if the gateway dies part way
+	// through eQ's retries aren't refused for the whole window.
+	claimTTL time.Duration
+)
+
+// txRecord is what we remember about a tx_id we've seen. A zero Status
+// means the submission is still being processed.
+type txRecord struct {
+	Hash   string `json:"hash"`
+	Status int    `json:"status,omitempty"`
+}
+
+// hashSurvey returns the digest used to decide whether two submissions with
+// the same tx_id are the same submission. It's taken over the decrypted
+// survey JSON as eQ will produce a different JWE for each retry.
+func hashSurvey(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// claimTx attempts to record that we're processing the given tx_id. If
+// successful it returns nil, otherwise it returns the record of the earlier
+// submission with the same tx_id. The claim lasts for claimTTL - completeTx
+// extends it to the full idempotency window.
+func claimTx(txID, hash string) (*txRecord, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	claim, err := json.Marshal(txRecord{Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < claimAttempts; attempt++ {
+		ok, err := redis.SetNXWithTTL(txKeyPrefix+txID, string(claim), claimTTL, conn)
+		if err != nil || ok {
+			return nil, err
+		}
+
+		existing, err := redis.GetString(txKeyPrefix+txID, conn)
+		if errors.Is(err, redis.ErrNil) {
+			// Expired (or released) between the SET and the GET - try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var record txRecord
+		if err = json.Unmarshal([]byte(existing), &record); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+	return nil, fmt.Errorf("unable to claim tx_id %s after %d attempts", txID, claimAttempts)
+}
+
+// holdTx extends our claim on a tx_id to the full idempotency window. It's
+// used once a submission has been queued, as it may be retried for longer
+// than claimTTL and a replay mustn't claim the tx_id again in the meantime.
+func holdTx(txID, hash string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	claim, err := json.Marshal(txRecord{Hash: hash})
+	if err != nil {
+		return err
+	}
+	return redis.SetWithTTL(txKeyPrefix+txID, string(claim), idempotencyWindow, conn)
+}
+
+// completeTx records the final result of processing a tx_id so that any
+// replay can be given the same answer.
+func completeTx(txID, hash string, status int) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	record, err := json.Marshal(txRecord{Hash: hash, Status: status})
+	if err != nil {
+		return err
+	}
+	return redis.SetWithTTL(txKeyPrefix+txID, string(record), idempotencyWindow, conn)
+}
+
+// releaseTx forgets a tx_id so that a failed submission can be retried
+func releaseTx(txID string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	return redis.Delete(txKeyPrefix+txID, conn)
+}
@@ -0,0 +1,231 @@
+// Package jobs provides a durable queue of submissions accepted by the
+// gateway but not yet processed, along with a pool of workers that process
+// them with retries.
+//
+// It backs the gateway's asynchronous mode, where a submission is persisted
+// and acknowledged with a 202 straight away rather than the client waiting
+// for the store and notify steps.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucket = []byte("jobs")
+
+// ErrExists is returned by Enqueue when a job is already queued for a tx_id
+var ErrExists = errors.New("job already queued")
+
+// Job is a submission waiting to be processed
+type Job struct {
+	TxID      string    `json:"tx_id"`
+	Body      []byte    `json:"body"` // What is to be processed, as given to Enqueue
+	QueuedAt  time.Time `json:"queued_at"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// ProcessFunc processes a job. A nil error means the job is done and can be
+// removed from the queue, otherwise it will be retried.
+type ProcessFunc func(Job) error
+
+// FailFunc is called when a job has used up all of its attempts, just
+// before it is removed from the queue.
+type FailFunc func(Job)
+
+// Options controls how jobs are worked
+type Options struct {
+	Workers     int           // Number of jobs processed at once
+	MaxAttempts int           // Attempts before a job is given up on
+	Backoff     time.Duration // Delay before the first retry, doubled for each subsequent retry
+}
+
+// Queue is a durable, file backed queue of jobs. It is safe for concurrent
+// use.
+type Queue struct {
+	db   *bolt.DB
+	work chan string
+
+	// done is closed when the workers are stopped, so that nothing waits to
+	// hand them a job any more
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Open opens (creating if needed) the queue file at the given path
+func Open(path string) (*Queue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Queue{db: db, work: make(chan string, 1024), done: make(chan struct{})}, nil
+}
+
+// Close closes the underlying file
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// Enqueue durably records a job for the given tx_id and body. When it returns
+// nil the job has been synced to disk and will be processed, even across a
+// restart. A job that is already queued is never replaced - ErrExists is
+// returned instead.
+func (q *Queue) Enqueue(txID string, body []byte) error {
+	if len(txID) == 0 {
+		return errors.New("job has no tx_id")
+	}
+	value, err := json.Marshal(&Job{TxID: txID, Body: body, QueuedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b.Get([]byte(txID)) != nil {
+			return ErrExists
+		}
+		return b.Put([]byte(txID), value)
+	}); err != nil {
+		return err
+	}
+	q.schedule(txID, 0)
+	return nil
+}
+
+// Start starts the workers, first queueing any jobs left over from a
+// previous run. Returns a cancel function to stop the workers.
+func (q *Queue) Start(opts Options, process ProcessFunc, failed FailFunc) (func(), error) {
+	var pending []string
+	if err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			pending = append(pending, string(k))
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	log.Printf(`event="Starting job workers" workers="%d" pending="%d"`, opts.Workers, len(pending))
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case txID := <-q.work:
+					q.process(txID, opts, process, failed)
+				}
+			}
+		}(ctx)
+	}
+
+	for _, txID := range pending {
+		q.schedule(txID, 0)
+	}
+
+	return func() {
+		log.Print(`event="Canceling job workers"`)
+		q.stopOnce.Do(func() { close(q.done) })
+		cancel()
+		wg.Wait()
+	}, nil
+}
+
+// process makes one attempt at a job, rescheduling or failing it as needed
+func (q *Queue) process(txID string, opts Options, process ProcessFunc, failed FailFunc) {
+	job, err := q.get(txID)
+	if err != nil {
+		log.Printf(`event="Failed to load job" tx_id="%s" error="%v"`, txID, err)
+		return
+	}
+	if job == nil {
+		// Already done (e.g. scheduled twice)
+		return
+	}
+
+	job.Attempts++
+	if err = process(*job); err == nil {
+		log.Printf(`event="Job complete" tx_id="%s" attempts="%d"`, txID, job.Attempts)
+		if err = q.remove(txID); err != nil {
+			log.Printf(`event="Failed to remove job" tx_id="%s" error="%v"`, txID, err)
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+	if job.Attempts >= opts.MaxAttempts {
+		log.Printf(`event="Job failed - giving up" tx_id="%s" attempts="%d" error="%v"`, txID, job.Attempts, err)
+		failed(*job)
+		if err = q.remove(txID); err != nil {
+			log.Printf(`event="Failed to remove job" tx_id="%s" error="%v"`, txID, err)
+		}
+		return
+	}
+
+	backoff := opts.Backoff << uint(job.Attempts-1)
+	log.Printf(`event="Job failed - retrying" tx_id="%s" attempts="%d" retry_in="%s" error="%v"`, txID, job.Attempts, backoff, err)
+	if err = q.put(*job); err != nil {
+		log.Printf(`event="Failed to update job" tx_id="%s" error="%v"`, txID, err)
+	}
+	q.schedule(txID, backoff)
+}
+
+// schedule hands a job to the workers after the given delay, without
+// blocking the caller. Once the workers have stopped the job is left on disk
+// for the next Start to pick up.
+func (q *Queue) schedule(txID string, after time.Duration) {
+	time.AfterFunc(after, func() {
+		select {
+		case q.work <- txID:
+		case <-q.done:
+		}
+	})
+}
+
+func (q *Queue) get(txID string) (*Job, error) {
+	var job *Job
+	err := q.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucket).Get([]byte(txID))
+		if v == nil {
+			return nil
+		}
+		job = &Job{}
+		return json.Unmarshal(v, job)
+	})
+	return job, err
+}
+
+func (q *Queue) put(j Job) error {
+	value, err := json.Marshal(&j)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(j.TxID), value)
+	})
+}
+
+func (q *Queue) remove(txID string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(txID))
+	})
+}
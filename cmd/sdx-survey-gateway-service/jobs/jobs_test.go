@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestQueueRetriesThenFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := Open(filepath.Join(dir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("Expected no error opening queue, got %v", err)
+	}
+	defer q.Close()
+
+	done := make(chan Job, 2)
+	process := func(j Job) error {
+		// "ok" succeeds on its second attempt, "bad" never succeeds
+		if j.TxID == "ok" && j.Attempts == 2 {
+			done <- j
+			return nil
+		}
+		return errors.New("store unavailable")
+	}
+	failed := func(j Job) { done <- j }
+
+	cancel, err := q.Start(Options{Workers: 2, MaxAttempts: 3, Backoff: time.Millisecond}, process, failed)
+	if err != nil {
+		t.Fatalf("Expected no error starting workers, got %v", err)
+	}
+	defer cancel()
+
+	q.Enqueue("ok", []byte("a.b.c.d.e"))
+	q.Enqueue("bad", []byte("a.b.c.d.e"))
+
+	results := map[string]Job{}
+	for i := 0; i < 2; i++ {
+		select {
+		case j := <-done:
+			results[j.TxID] = j
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for jobs")
+		}
+	}
+
+	if results["ok"].Attempts != 2 || string(results["ok"].Body) != "a.b.c.d.e" {
+		t.Errorf("Expected ok to succeed on attempt 2, got %+v", results["ok"])
+	}
+	if results["bad"].Attempts != 3 || results["bad"].LastError != "store unavailable" {
+		t.Errorf("Expected bad to fail after 3 attempts, got %+v", results["bad"])
+	}
+
+	// Both are removed once finished with
+	for _, id := range []string{"ok", "bad"} {
+		removed := false
+		for i := 0; i < 100 && !removed; i++ {
+			j, _ := q.get(id)
+			if removed = j == nil; !removed {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if !removed {
+			t.Errorf("Expected %s to be removed from the queue", id)
+		}
+	}
+}
+
+func TestScheduleAfterCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := Open(filepath.Join(dir, "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	cancel, err := q.Start(Options{Workers: 1, MaxAttempts: 1}, func(Job) error { return nil }, func(Job) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// More retries than the workers' channel holds, with nothing to take
+	// them - none may be left waiting
+	before := runtime.NumGoroutine()
+	for i := 0; i < 2*cap(q.work); i++ {
+		q.schedule("job", 0)
+	}
+	// The scheduled sends run in goroutines of their own - give them time
+	// to start and finish
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected scheduled jobs not to block once cancelled, %d goroutines left waiting", n-before)
+	}
+}
+
+func TestEnqueueExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := Open(filepath.Join(dir, "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if err = q.Enqueue("abc", []byte("first")); err != nil {
+		t.Fatalf("Expected no error queueing a job, got %v", err)
+	}
+	if err = q.Enqueue("abc", []byte("second")); !errors.Is(err, ErrExists) {
+		t.Errorf("Expected ErrExists queueing the same tx_id again, got %v", err)
+	}
+	if j, _ := q.get("abc"); j == nil || string(j.Body) != "first" {
+		t.Errorf("Expected the queued job to be kept, got %+v", j)
+	}
+}
@@ -0,0 +1,186 @@
+// Package keyring holds the keys used by the gateway for decrypting and
+// verifying survey data, indexed by purpose and key ID (kid).
+//
+// Keys are loaded from a directory laid out as:
+//
+//	<dir>/<purpose>/<kid>.private.pem
+//	<dir>/<purpose>/<kid>.public.pem
+//
+// e.g. <dir>/eq-submission/sdx-2017q4.private.pem. Every key present for a
+// purpose is considered active, so during rotation the new key is dropped in
+// alongside the old one and the old one removed once nothing uses it. Keys
+// are re-read on SIGHUP so none of this requires a restart.
+package keyring
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ONSdigital/sdx-evolution/internal/jose"
+	"github.com/ONSdigital/sdx-evolution/internal/signals"
+)
+
+const (
+	privateSuffix = ".private.pem"
+	publicSuffix  = ".public.pem"
+)
+
+// Keyring is a concurrency safe store of keys
+type Keyring struct {
+	dir string
+
+	mu       sync.RWMutex
+	purposes map[string]*purposeKeys
+}
+
+type purposeKeys struct {
+	private map[string]*rsa.PrivateKey
+	public  map[string]*rsa.PublicKey
+}
+
+// Load creates a Keyring from the keys found in the given directory
+func Load(dir string) (*Keyring, error) {
+	k := &Keyring{dir: dir}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the key directory. If any key fails to load the existing
+// keys are left in place and an error returned, so a bad rotation never
+// leaves us with no keys at all.
+func (k *Keyring) Reload() error {
+	dirs, err := ioutil.ReadDir(k.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read key directory: %v", err)
+	}
+
+	purposes := make(map[string]*purposeKeys)
+	count := 0
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		keys, err := loadPurpose(filepath.Join(k.dir, d.Name()))
+		if err != nil {
+			return err
+		}
+		purposes[d.Name()] = keys
+		count += len(keys.private) + len(keys.public)
+	}
+
+	k.mu.Lock()
+	k.purposes = purposes
+	k.mu.Unlock()
+
+	log.Printf(`event="Loaded keyring" dir="%s" purposes="%d" keys="%d"`, k.dir, len(purposes), count)
+	return nil
+}
+
+func loadPurpose(dir string) (*purposeKeys, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory: %v", err)
+	}
+
+	keys := &purposeKeys{
+		private: make(map[string]*rsa.PrivateKey),
+		public:  make(map[string]*rsa.PublicKey),
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !(strings.HasSuffix(name, privateSuffix) || strings.HasSuffix(name, publicSuffix)) {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key [%s]: %v", path, err)
+		}
+
+		if strings.HasSuffix(name, privateSuffix) {
+			if keys.private[strings.TrimSuffix(name, privateSuffix)], err = jose.ParsePrivateKeyPEM(data); err != nil {
+				return nil, fmt.Errorf("failed to parse private key [%s]: %v", path, err)
+			}
+			continue
+		}
+		if keys.public[strings.TrimSuffix(name, publicSuffix)], err = jose.ParsePublicKeyPEM(data); err != nil {
+			return nil, fmt.Errorf("failed to parse public key [%s]: %v", path, err)
+		}
+	}
+	return keys, nil
+}
+
+// PrivateKeys returns the private keys for a purpose that may be used with
+// the given kid. If kid is empty every active private key for the purpose is
+// returned so the caller can try each in turn.
+func (k *Keyring) PrivateKeys(purpose, kid string) []*rsa.PrivateKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	p, ok := k.purposes[purpose]
+	if !ok {
+		return nil
+	}
+	if len(kid) > 0 {
+		if key, ok := p.private[kid]; ok {
+			return []*rsa.PrivateKey{key}
+		}
+		return nil
+	}
+
+	keys := make([]*rsa.PrivateKey, 0, len(p.private))
+	for _, key := range p.private {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// PublicKeys returns the public keys for a purpose that may be used with
+// the given kid. If kid is empty every active public key for the purpose is
+// returned so the caller can try each in turn.
+func (k *Keyring) PublicKeys(purpose, kid string) []*rsa.PublicKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	p, ok := k.purposes[purpose]
+	if !ok {
+		return nil
+	}
+	if len(kid) > 0 {
+		if key, ok := p.public[kid]; ok {
+			return []*rsa.PublicKey{key}
+		}
+		return nil
+	}
+
+	keys := make([]*rsa.PublicKey, 0, len(p.public))
+	for _, key := range p.public {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ReloadOnSIGHUP reloads the keyring each time the process receives a
+// SIGHUP. It returns a cancel function to stop watching.
+func (k *Keyring) ReloadOnSIGHUP() func() {
+	return signals.HandleEachFunc(
+		func(sig os.Signal) {
+			if err := k.Reload(); err != nil {
+				log.Printf(`event="Failed to reload keyring - keeping existing keys" error="%v"`, err)
+			}
+		},
+		syscall.SIGHUP,
+	)
+}
@@ -0,0 +1,111 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeKey(t *testing.T, dir, purpose, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	os.MkdirAll(filepath.Join(dir, purpose), 0700)
+	ioutil.WriteFile(
+		filepath.Join(dir, purpose, kid+privateSuffix),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		0600,
+	)
+	ioutil.WriteFile(
+		filepath.Join(dir, purpose, kid+publicSuffix),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}),
+		0600,
+	)
+	return key
+}
+
+func TestKeyringLookupAndRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q3 := writeKey(t, dir, "eq-submission", "2017q3")
+
+	k, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Expected no error loading keyring, got %v", err)
+	}
+
+	if keys := k.PrivateKeys("eq-submission", "2017q3"); len(keys) != 1 || keys[0].N.Cmp(q3.N) != 0 {
+		t.Error("Expected to find private key by kid")
+	}
+	if keys := k.PublicKeys("eq-submission", "2017q3"); len(keys) != 1 {
+		t.Error("Expected to find public key by kid")
+	}
+	if keys := k.PrivateKeys("eq-submission", "unknown"); len(keys) != 0 {
+		t.Error("Expected no keys for unknown kid")
+	}
+	if keys := k.PrivateKeys("sdx-storage", ""); len(keys) != 0 {
+		t.Error("Expected no keys for unknown purpose")
+	}
+
+	// Rotate - both keys are active until the old one is removed
+	writeKey(t, dir, "eq-submission", "2017q4")
+	if err = k.Reload(); err != nil {
+		t.Fatalf("Expected no error reloading keyring, got %v", err)
+	}
+	if keys := k.PrivateKeys("eq-submission", ""); len(keys) != 2 {
+		t.Errorf("Expected 2 active keys after rotation, got %d", len(keys))
+	}
+
+	// A broken key fails the reload but leaves the existing keys in place
+	ioutil.WriteFile(filepath.Join(dir, "eq-submission", "broken"+privateSuffix), []byte("nope"), 0600)
+	if err = k.Reload(); err == nil {
+		t.Error("Expected error reloading with a broken key")
+	}
+	if keys := k.PrivateKeys("eq-submission", ""); len(keys) != 2 {
+		t.Errorf("Expected existing keys to be kept, got %d", len(keys))
+	}
+}
+
+func TestKeyringReloadOnSIGHUP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeKey(t, dir, "eq-submission", "2017q3")
+	k, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel := k.ReloadOnSIGHUP()
+	defer cancel()
+
+	// Every SIGHUP reloads, not just the first
+	for i, kid := range []string{"2017q4", "2018q1"} {
+		writeKey(t, dir, "eq-submission", kid)
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(k.PrivateKeys("eq-submission", kid)) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if keys := k.PrivateKeys("eq-submission", ""); len(keys) != i+2 {
+			t.Fatalf("Expected %d active keys after SIGHUP %d, got %d", i+2, i+1, len(keys))
+		}
+	}
+}
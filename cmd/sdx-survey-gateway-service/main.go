@@ -1,28 +1,61 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/backpressure"
 	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/config"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/jobs"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/keyring"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/origins"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/outbox"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/schema"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/store"
 	"github.com/ONSdigital/sdx-evolution/internal/api"
+	"github.com/ONSdigital/sdx-evolution/internal/cloudevents"
+	"github.com/ONSdigital/sdx-evolution/internal/notification"
 	"github.com/ONSdigital/sdx-evolution/internal/rabbit"
+	redis "github.com/ONSdigital/sdx-evolution/internal/redis"
 	"github.com/ONSdigital/sdx-evolution/internal/signals"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
 
 	"github.com/gorilla/mux"
 	"github.com/streadway/amqp"
 )
 
+const (
+	// publishConfirmTimeout is how long to wait for the broker to confirm a
+	// published notification
+	publishConfirmTimeout = time.Second * 5
+
+	// eventSource is the CloudEvents source of our notifications
+	eventSource = "/sdx/survey-gateway"
+)
+
 var (
-	rabbitConn *amqp.Connection
+	storeClient  *store.Client
+	rabbitConn   *amqp.Connection
+	publishers   *rabbit.PublisherPool
+	notifyOutbox *outbox.Outbox
+
+	// maxBodyBytes and bulkMaxBodyBytes are the largest bodies accepted for
+	// a single survey and a bulk submission
+	maxBodyBytes     int64
+	bulkMaxBodyBytes int64
+
+	// eventMode is how notifications are published as CloudEvents. Empty
+	// means as a plain notification.
+	eventMode cloudevents.Mode
 )
 
 func main() {
@@ -47,24 +80,181 @@ func main() {
 	)
 	defer cancelSigWatch()
 
+	// Keys for decrypting and verifying posted survey data. These are re-read
+	// on SIGHUP so they can be rotated without a restart.
+	var err error
+	if keys, err = keyring.Load(config.C["KEYS_DIR"]); err != nil {
+		log.Fatalf(`event="Failed to start - unable to load keys" error="%v"`, err)
+	}
+	cancelKeyWatch := keys.ReloadOnSIGHUP()
+	defer cancelKeyWatch()
+
+	// Schemas for validating survey data
+	if schemas, err = schema.Load(config.C["SCHEMAS_DIR"]); err != nil {
+		log.Fatalf(`event="Failed to start - unable to load schemas" error="%v"`, err)
+	}
+	rejectUnknownSurveys = config.C["REJECT_UNKNOWN_SURVEYS"] == "true"
+
+	// Redis - used to remember the tx_ids we've accepted
+	if idempotencyWindow, err = time.ParseDuration(config.C["IDEMPOTENCY_WINDOW"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid IDEMPOTENCY_WINDOW" error="%v"`, err)
+	}
+	if claimTTL, err = time.ParseDuration(config.C["IDEMPOTENCY_CLAIM_TTL"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid IDEMPOTENCY_CLAIM_TTL" error="%v"`, err)
+	}
+	redisPool = redis.NewPool(config.C["REDIS_URL"], 10)
+	defer redisPool.Close()
+
+	// Pipeline tracking - shared with the other services via redis
+	stages = tracker.New(redisPool, "sdx-survey-gateway-service")
+
+	// Request body limits
+	if maxBodyBytes, err = strconv.ParseInt(config.C["MAX_BODY_BYTES"], 10, 64); err != nil {
+		log.Fatalf(`event="Failed to start - invalid MAX_BODY_BYTES" error="%v"`, err)
+	}
+	if bulkMaxBodyBytes, err = strconv.ParseInt(config.C["BULK_MAX_BODY_BYTES"], 10, 64); err != nil {
+		log.Fatalf(`event="Failed to start - invalid BULK_MAX_BODY_BYTES" error="%v"`, err)
+	}
+
+	// Origins allowed to submit, with their credentials and rate limits
+	if path := config.C["ORIGINS_FILE"]; len(path) > 0 {
+		if allowedOrigins, err = origins.Load(path); err != nil {
+			log.Fatalf(`event="Failed to start - unable to load origins" error="%v"`, err)
+		}
+	} else {
+		log.Print(`event="No ORIGINS_FILE - submissions will not be authenticated or rate limited"`)
+	}
+
+	// SEFT returns
+	if seftMaxBytes, err = strconv.ParseInt(config.C["SEFT_MAX_BYTES"], 10, 64); err != nil {
+		log.Fatalf(`event="Failed to start - invalid SEFT_MAX_BYTES" error="%v"`, err)
+	}
+	seftContentTypes = make(map[string]bool)
+	for _, t := range strings.Split(config.C["SEFT_CONTENT_TYPES"], ",") {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			seftContentTypes[t] = true
+		}
+	}
+
+	// Store service - calls are bounded, retried and stopped altogether by a
+	// circuit breaker if the store keeps failing
+	var storeOpts store.Options
+	if storeOpts.Timeout, err = time.ParseDuration(config.C["STORE_TIMEOUT"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid STORE_TIMEOUT" error="%v"`, err)
+	}
+	if storeOpts.AttemptTimeout, err = time.ParseDuration(config.C["STORE_ATTEMPT_TIMEOUT"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid STORE_ATTEMPT_TIMEOUT" error="%v"`, err)
+	}
+	if storeOpts.MaxAttempts, err = strconv.Atoi(config.C["STORE_MAX_ATTEMPTS"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid STORE_MAX_ATTEMPTS" error="%v"`, err)
+	}
+	storeClient = store.New(config.C["STORE_URL"], storeOpts)
+
 	// RabbitMQ
+	if config.C["CLOUDEVENTS_MODE"] != "none" {
+		if eventMode, err = cloudevents.ParseMode(config.C["CLOUDEVENTS_MODE"]); err != nil {
+			log.Fatalf(`event="Failed to start - invalid CLOUDEVENTS_MODE" error="%v"`, err)
+		}
+	}
 	rabbitConn = rabbit.ConnectWithRetry(config.C["RABBIT_URL"], time.Second*2)
 	defer rabbitConn.Close()
 
+	// Backpressure - turn submissions away while the broker is blocking us
+	// or the queue behind us is backing up
+	var pressureOpts backpressure.Options
+	pressureOpts.Queue = config.C["BACKPRESSURE_QUEUE"]
+	if pressureOpts.MaxDepth, err = strconv.Atoi(config.C["BACKPRESSURE_MAX_DEPTH"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid BACKPRESSURE_MAX_DEPTH" error="%v"`, err)
+	}
+	if pressureOpts.Interval, err = time.ParseDuration(config.C["BACKPRESSURE_INTERVAL"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid BACKPRESSURE_INTERVAL" error="%v"`, err)
+	}
+	if shedRetryAfter, err = time.ParseDuration(config.C["BACKPRESSURE_RETRY_AFTER"]); err != nil {
+		log.Fatalf(`event="Failed to start - invalid BACKPRESSURE_RETRY_AFTER" error="%v"`, err)
+	}
+	pressure = backpressure.Start(rabbitConn, pressureOpts)
+	cancelPolling := pressure.PollQueue(rabbitConn)
+	defer cancelPolling()
+
+	// Publishing channels are shared between requests rather than opened
+	// for each one
+	poolSize, err := strconv.Atoi(config.C["RABBIT_PUBLISH_CHANNELS"])
+	if err != nil {
+		log.Fatalf(`event="Failed to start - invalid RABBIT_PUBLISH_CHANNELS" error="%v"`, err)
+	}
+	if publishers, err = rabbit.NewPublisherPool(rabbitConn, poolSize, publishConfirmTimeout); err != nil {
+		log.Fatalf(`event="Failed to start - unable to create publisher pool" error="%v"`, err)
+	}
+	defer publishers.Close()
+
+	if err = publishers.DeclareExchange(config.C["NOTIFICATION_EXCHANGE"]); err != nil {
+		log.Fatalf(`event="Failed to declare exchange" exchange="%s" error="%v"`, config.C["NOTIFICATION_EXCHANGE"], err)
+	}
+
+	// Outbox - notifications for stored surveys that are yet to be published
+	relayInterval, err := time.ParseDuration(config.C["OUTBOX_RELAY_INTERVAL"])
+	if err != nil {
+		log.Fatalf(`event="Failed to start - invalid OUTBOX_RELAY_INTERVAL" error="%v"`, err)
+	}
+	if notifyOutbox, err = outbox.Open(config.C["OUTBOX_PATH"]); err != nil {
+		log.Fatalf(`event="Failed to start - unable to open outbox" error="%v"`, err)
+	}
+	defer notifyOutbox.Close()
+
+	cancelRelay := notifyOutbox.StartRelay(relayInterval, publishEntry)
+	defer cancelRelay()
+
+	// Asynchronous mode - submissions are queued and processed in the
+	// background rather than while the client waits
+	if config.C["ASYNC_SUBMISSIONS"] == "true" {
+		if asyncJobs, err = jobs.Open(config.C["ASYNC_QUEUE_PATH"]); err != nil {
+			log.Fatalf(`event="Failed to start - unable to open job queue" error="%v"`, err)
+		}
+		defer asyncJobs.Close()
+
+		opts := jobs.Options{Backoff: asyncRetryBackoff}
+		if opts.Workers, err = strconv.Atoi(config.C["ASYNC_WORKERS"]); err != nil {
+			log.Fatalf(`event="Failed to start - invalid ASYNC_WORKERS" error="%v"`, err)
+		}
+		if opts.MaxAttempts, err = strconv.Atoi(config.C["ASYNC_MAX_ATTEMPTS"]); err != nil {
+			log.Fatalf(`event="Failed to start - invalid ASYNC_MAX_ATTEMPTS" error="%v"`, err)
+		}
+		cancelWorkers, err := asyncJobs.Start(opts, processJob, failJob)
+		if err != nil {
+			log.Fatalf(`event="Failed to start - unable to start job workers" error="%v"`, err)
+		}
+		defer cancelWorkers()
+	}
+
 	// Webserver
-	r := mux.NewRouter()
-	r.HandleFunc("/healthcheck", HealthcheckHandler).Methods("GET")
-	r.HandleFunc("/survey", PostedSurveyHandler).Methods("POST")
-	http.Handle("/", r)
-	log.Print(http.ListenAndServe(fmt.Sprintf(":%s", config.C["PORT"]), nil))
+	r := newRouter()
+
+	// Operational endpoints are served on their own port, which isn't
+	// exposed beyond the service's network, rather than next to submissions
+	admin := mux.NewRouter()
+	admin.HandleFunc("/admin/outbox", PendingOutboxHandler).Methods("GET")
+	admin.HandleFunc("/survey/{tx_id}/status", SurveyStatusHandler).Methods("GET")
+	admin.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	go func() {
+		log.Fatalf(`event="Admin webserver stopped" error="%v"`, http.ListenAndServe(fmt.Sprintf(":%s", config.C["ADMIN_PORT"]), admin))
+	}()
+
+	log.Print(listenAndServe(
+		fmt.Sprintf(":%s", config.C["PORT"]),
+		r,
+		config.C["TLS_CERT_FILE"],
+		config.C["TLS_KEY_FILE"],
+		config.C["TLS_CLIENT_CA_FILE"],
+	))
 }
 
-// PostedSurveyHandler takes posted survey data (encrypted) and processes it
+// PostedSurveyHandler takes posted survey data (encrypted) and processes it.
+// In asynchronous mode it is queued for processing and a 202 returned. With
+// ?dry_run=true it is only checked (see dryRunSurvey).
 func PostedSurveyHandler(rw http.ResponseWriter, r *http.Request) {
 
-	// Grab the posted data from the client. This WILL be an encrypted blob
-	// of JWS lovelyness, but for now we're skipping that step and assuming
-	// it's already decrypted by using plain json.
+	// Grab the posted data from the client. This is an encrypted blob of
+	// JWS lovelyness (a JWE wrapping a signed JWS) which we unwrap below.
 	//
 	// nb. Don't need to close the request body - the server does that for
 	//     us - https://golang.org/pkg/net/http/#Request
@@ -86,102 +276,102 @@ func PostedSurveyHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Assuming everything is ok with what we receieved (and decrypted)
-	// we then go on to:
-	//	- store the survey into the datastore (via service)
-	// 	- place a notification of the event onto the notify exchange
-	var survey Survey
-	if err := json.Unmarshal(body, &survey); err != nil {
-		log.Printf(`event="Failed to parse survey JSON" error="%v"`, err)
-		api.WriteProblemResponse(api.Problem{
-			Title:  "Failed to parse survey JSON",
-			Status: http.StatusBadRequest,
-		}, rw)
+	if isDryRun(r) {
+		dryRunSurvey(r.Context(), rw, body)
 		return
 	}
-	log.Printf(
-		`event="Received survey data" survey_id="%s" instrument_id="%s" tx_id="%v"`,
-		survey.SurveyID,
-		survey.Collection.InstrumentID,
-		survey.TxID,
-	)
 
-	// Fire to data store
-	log.Printf(`event="Attempting to store survey data" tx_id="%s"`, survey.TxID)
-	if err = storeSurvey(body); err != nil {
-		log.Printf(`event="Failed to store survey JSON" error="%v"`, err)
-		api.WriteProblemResponse(api.Problem{
-			Title:  "Failed to store survey JSON",
-			Status: http.StatusBadRequest,
-		}, rw)
+	if asyncJobs != nil {
+		acceptSurveyAsync(r.Context(), rw, body)
 		return
 	}
 
-	// Notify
-	log.Printf(`event="Attempting to publish notification" tx_id="%s"`, survey.TxID)
-	if err := publishNotification(survey.TxID, "eq", survey.SurveyID, survey.Collection.InstrumentID); err != nil {
-		log.Printf(`event="Failed to publish survey notification event" error="%v"`, err)
-		// TODO What happens if we fail to publish?
-		//		- Could attempt a few reties?
-		//		- Responsibility should be on calling service to handle and retry
-		api.WriteProblemResponse(api.Problem{
-			Title:  "Failed to notify request",
-			Status: http.StatusInternalServerError,
-			Detail: "Unable to route survey receipt notification at this time",
-		}, rw)
+	_, status, problem := submitSurvey(r.Context(), body)
+	if problem != nil {
+		api.WriteProblemResponse(*problem, rw)
 		return
 	}
-
-	rw.WriteHeader(http.StatusOK)
+	rw.WriteHeader(status)
 }
 
-func storeSurvey(data []byte) error {
-	log.Printf(`event="Attempting to store" store="%s"`, config.C["STORE_URL"])
-	resp, err := http.Post(config.C["STORE_URL"]+"/survey", "application/json", bytes.NewBuffer(data))
-	if err != nil {
-		return err
+// abandonTx releases our claim on a tx_id after a failure so that eQ's retry
+// is processed rather than being treated as a replay.
+func abandonTx(txID string) {
+	if err := releaseTx(txID); err != nil {
+		log.Printf(`event="Failed to release tx_id" tx_id="%s" error="%v"`, txID, err)
 	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Bad response from STORE: %s", resp.Status)
+// publishEntry publishes the notification for an outbox entry
+func publishEntry(e outbox.Entry) error {
+	receivedAt := e.ReceivedAt
+	if receivedAt.IsZero() {
+		// Entries added before received_at was recorded
+		receivedAt = e.CreatedAt
+	}
+	if err := publishNotification(notification.Notification{
+		TxID:         e.TxID,
+		Source:       e.Source,
+		SurveyID:     e.SurveyID,
+		InstrumentID: e.InstrumentID,
+		Period:       e.Period,
+		ExerciseSID:  e.ExerciseSID,
+		ReceivedAt:   receivedAt,
+	}); err != nil {
+		return err
 	}
-	log.Print(`event="Stored survey"`)
+	stages.Record(e.TxID, tracker.Notified, "")
 	return nil
 }
 
-func publishNotification(id, source, surveyID, instrumentID string) error {
+func publishNotification(n notification.Notification) error {
 
-	if rabbitConn == nil {
+	if publishers == nil {
 		return errors.New("No connection to rabbit")
 	}
 
-	topic := fmt.Sprintf("survey.notify.%s.%s.%s", source, surveyID, instrumentID)
-
-	// Get a fresh channel for each publish
-	// TODO do we need to do this? May be a way of reducing the number of
-	//		open/closes (though publishers can't be shared during operation)
-	ch, err := rabbitConn.Channel()
+	var msg amqp.Publishing
+	var err error
+	if len(eventMode) > 0 {
+		msg, err = n.CloudEvent(eventMode, n.TxID, eventSource, notification.NotifyEventType)
+	} else {
+		msg, err = n.Publishing()
+	}
 	if err != nil {
 		return err
 	}
-	defer ch.Close()
 
-	if err = rabbit.DeclareExchangeWithDefaults(config.C["NOTIFICATION_EXCHANGE"], ch); err != nil {
-		log.Fatalf(`event="Failed to declare exchange" exchange="%s" error="%v"`, config.C["NOTIFICATION_EXCHANGE"], err)
-	}
+	topic := fmt.Sprintf("survey.notify.%s.%s.%s", n.Source, n.SurveyID, n.InstrumentID)
 
-	if err = ch.Publish(
-		config.C["NOTIFICATION_EXCHANGE"],
-		topic,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(id),
-		}); err != nil {
+	// Wait for the broker to confirm it has the notification - until then
+	// we can't report success (or remove it from the outbox)
+	if err = publishers.Publish(config.C["NOTIFICATION_EXCHANGE"], topic, msg); err != nil {
 		return err
 	}
 
-	log.Printf(`event="Published notification to '%s'"`, topic)
+	log.Printf(`event="Published notification to '%s'" tx_id="%s"`, topic, n.TxID)
 	return nil
 }
+
+// newRouter creates the router for the public endpoints - submissions and
+// their status
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthcheck", HealthcheckHandler).Methods("GET")
+
+	// Submissions are authenticated before their body is read. The body
+	// limits mean none of the handlers can be made to read an unbounded body.
+	surveyBody := api.Body(maxBodyBytes, "application/json", "application/jose")
+	bulkBody := api.Body(bulkMaxBodyBytes, "application/json", "application/jose", "application/x-ndjson")
+	seftBody := api.Body(seftMaxBytes+seftMaxMetadata+seftMultipartOverhead, "multipart/form-data")
+
+	// Anything that ends up published is shed first of all when the pipeline
+	// is overloaded. A dry run (/survey/validate or /survey?dry_run=true)
+	// publishes nothing so isn't - the other routes don't do dry runs.
+	r.Handle("/survey", shedLoadUnlessDryRun(requireOrigin(surveyBody(http.HandlerFunc(PostedSurveyHandler))))).Methods("POST")
+	r.Handle("/survey/validate", requireOrigin(surveyBody(http.HandlerFunc(ValidateSurveyHandler)))).Methods("POST")
+	r.Handle("/surveys", shedLoad(requireBatchOrigin(bulkBody(http.HandlerFunc(BulkSurveysHandler))))).Methods("POST")
+	r.Handle("/seft", shedLoad(requireOrigin(seftBody(http.HandlerFunc(PostedSEFTHandler))))).Methods("POST")
+	r.Handle("/survey/{tx_id}/status", requireKnownOrigin(http.HandlerFunc(SurveyStatusHandler))).Methods("GET")
+	return r
+}
@@ -0,0 +1,49 @@
+package origins
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket rate limiter. It holds up to burst tokens and is
+// refilled at rate tokens a second; each request takes one (or one per
+// submission for a batch).
+type bucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// take removes n tokens if there are that many. Otherwise it returns false
+// and how long until there will be - or 0 if n is more than the bucket holds,
+// as there never will be.
+func (b *bucket) take(now time.Time, n int) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	want := float64(n)
+	if want > b.burst {
+		return false, 0
+	}
+	if b.tokens >= want {
+		b.tokens -= want
+		return true, 0
+	}
+	wait := time.Duration((want - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
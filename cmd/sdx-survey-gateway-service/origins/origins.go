@@ -0,0 +1,157 @@
+// Package origins holds the set of upstream systems (origins) allowed to
+// submit to the gateway, each with its own credential and rate limit.
+//
+// Origins are loaded from a JSON file:
+//
+//	[
+//	  {
+//	    "name": "uk.gov.ons.edc.eq",
+//	    "token_sha256": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+//	    "client_subject": "CN=eq.ons.gov.uk,O=ONS,C=GB",
+//	    "rate": 50,
+//	    "burst": 100
+//	  }
+//	]
+//
+// An origin authenticates with either a bearer token (only its SHA-256 is
+// kept in the file, hex encoded) or a verified TLS client certificate with
+// the given subject. The name is what the origin puts in the survey's
+// "origin" field. Rate is the sustained number of requests a second and burst
+// the most allowed at once; a rate of 0 means unlimited.
+package origins
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries neither a bearer
+	// token nor a client certificate
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrBadCredentials is returned when a request's credentials don't
+	// match any origin
+	ErrBadCredentials = errors.New("credentials not recognised")
+)
+
+// Origin is a system allowed to submit to the gateway
+type Origin struct {
+	Name          string  `json:"name"`
+	TokenSHA256   string  `json:"token_sha256,omitempty"`
+	ClientSubject string  `json:"client_subject,omitempty"`
+	Rate          float64 `json:"rate,omitempty"`
+	Burst         int     `json:"burst,omitempty"`
+
+	tokenHash []byte
+	limiter   *bucket
+}
+
+// Allow takes a request from the origin's rate limit. If the limit has been
+// reached it returns false along with how long until a request would be
+// allowed.
+func (o *Origin) Allow() (bool, time.Duration) {
+	return o.AllowN(1)
+}
+
+// AllowN is Allow for n requests at once, e.g. a batch of submissions. Either
+// all of them are allowed or none are. More than the origin's burst is never
+// allowed, in which case the duration returned is 0.
+func (o *Origin) AllowN(n int) (bool, time.Duration) {
+	if o.limiter == nil || n <= 0 {
+		return true, 0
+	}
+	return o.limiter.take(time.Now(), n)
+}
+
+// Registry is the set of configured origins. It is safe for concurrent use.
+type Registry struct {
+	origins []*Origin
+}
+
+// Load reads the origins from the JSON file at path
+func Load(path string) (*Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var origins []*Origin
+	if err = json.Unmarshal(data, &origins); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		switch {
+		case len(o.Name) == 0:
+			return nil, errors.New("origin with no name")
+		case seen[o.Name]:
+			return nil, fmt.Errorf("origin %q given more than once", o.Name)
+		case len(o.TokenSHA256) == 0 && len(o.ClientSubject) == 0:
+			return nil, fmt.Errorf("origin %q has neither token_sha256 nor client_subject", o.Name)
+		case o.Rate < 0 || o.Burst < 0:
+			return nil, fmt.Errorf("origin %q has a negative rate limit", o.Name)
+		}
+		seen[o.Name] = true
+
+		if len(o.TokenSHA256) > 0 {
+			if o.tokenHash, err = hex.DecodeString(o.TokenSHA256); err != nil || len(o.tokenHash) != sha256.Size {
+				return nil, fmt.Errorf("origin %q has an invalid token_sha256", o.Name)
+			}
+		}
+		if o.Rate > 0 {
+			burst := o.Burst
+			if burst == 0 {
+				burst = 1
+			}
+			o.limiter = newBucket(o.Rate, burst)
+		}
+	}
+	return &Registry{origins: origins}, nil
+}
+
+// Authenticate finds the origin a request comes from. A verified client
+// certificate is checked first, then the Authorization header.
+func (reg *Registry) Authenticate(r *http.Request) (*Origin, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject.String()
+		for _, o := range reg.origins {
+			if len(o.ClientSubject) > 0 && o.ClientSubject == subject {
+				return o, nil
+			}
+		}
+		return nil, ErrBadCredentials
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) == 0 {
+		return nil, ErrNoCredentials
+	}
+	const prefix = "bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return nil, ErrBadCredentials
+	}
+
+	// Compare digests in constant time so a token can't be guessed a byte
+	// at a time
+	digest := sha256.Sum256([]byte(strings.TrimSpace(auth[len(prefix):])))
+	var found *Origin
+	for _, o := range reg.origins {
+		if o.tokenHash != nil && subtle.ConstantTimeCompare(o.tokenHash, digest[:]) == 1 {
+			found = o
+		}
+	}
+	if found == nil {
+		return nil, ErrBadCredentials
+	}
+	return found, nil
+}
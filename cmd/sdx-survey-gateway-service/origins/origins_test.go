@@ -0,0 +1,125 @@
+package origins
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func load(t *testing.T, config string) *Registry {
+	dir, err := ioutil.TempDir("", "origins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "origins.json")
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Expected origins to load, got %v", err)
+	}
+	return reg
+}
+
+func TestAuthenticate(t *testing.T) {
+	digest := sha256.Sum256([]byte("s3cret"))
+	reg := load(t, fmt.Sprintf(`[
+		{"name": "eq", "token_sha256": "%s"},
+		{"name": "seft", "client_subject": "CN=seft.ons.gov.uk,O=ONS"}
+	]`, hex.EncodeToString(digest[:])))
+
+	r := httptest.NewRequest("POST", "/survey", nil)
+	if _, err := reg.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected ErrNoCredentials, got %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := reg.Authenticate(r); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("Expected ErrBadCredentials for wrong token, got %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer s3cret")
+	if o, err := reg.Authenticate(r); err != nil || o.Name != "eq" {
+		t.Errorf("Expected eq origin for token, got %v (%v)", o, err)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "seft.ons.gov.uk", Organization: []string{"ONS"}}}
+	r = httptest.NewRequest("POST", "/seft", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if o, err := reg.Authenticate(r); err != nil || o.Name != "seft" {
+		t.Errorf("Expected seft origin for client certificate, got %v (%v)", o, err)
+	}
+
+	cert.Subject.CommonName = "other.ons.gov.uk"
+	if _, err := reg.Authenticate(r); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("Expected ErrBadCredentials for unknown subject, got %v", err)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "origins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, config := range map[string]string{
+		"no name":        `[{"client_subject": "CN=a"}]`,
+		"no credentials": `[{"name": "a"}]`,
+		"bad digest":     `[{"name": "a", "token_sha256": "abc"}]`,
+		"duplicate":      `[{"name": "a", "client_subject": "CN=a"}, {"name": "a", "client_subject": "CN=b"}]`,
+	} {
+		path := filepath.Join(dir, "origins.json")
+		ioutil.WriteFile(path, []byte(config), 0600)
+		if _, err := Load(path); err == nil {
+			t.Errorf("Expected error loading origins with %s", name)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(2, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(now, 1); !ok {
+			t.Fatalf("Expected request %d within burst to be allowed", i)
+		}
+	}
+	ok, wait := b.take(now, 1)
+	if ok {
+		t.Fatal("Expected request beyond burst to be refused")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %s", wait)
+	}
+
+	if ok, _ = b.take(now.Add(wait), 1); !ok {
+		t.Error("Expected request to be allowed once refilled")
+	}
+
+	// A batch is taken whole or not at all
+	now = now.Add(2 * time.Second)
+	if ok, wait = b.take(now, 3); ok || wait != 0 {
+		t.Errorf("Expected a batch bigger than the burst never to be allowed, got %v %s", ok, wait)
+	}
+	if ok, _ = b.take(now, 2); !ok {
+		t.Error("Expected a batch within the burst to be allowed")
+	}
+	if ok, wait = b.take(now, 2); ok || wait != time.Second {
+		t.Errorf("Expected to wait 1s for a batch of 2, got %v %s", ok, wait)
+	}
+}
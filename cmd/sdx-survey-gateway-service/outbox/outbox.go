@@ -0,0 +1,229 @@
+// Package outbox provides a durable record of survey notifications that
+// have yet to be published, along with a relay that keeps trying to
+// publish them.
+//
+// The gateway adds an entry once a survey has been stored and removes it
+// once the notification has been published. If the publish fails (or the
+// gateway dies part way through) the entry stays in the outbox and the
+// relay picks it up, so a stored survey is never left unrouted.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucket = []byte("pending")
+
+// Metrics for the relay, published at /debug/vars
+var (
+	metrics   = expvar.NewMap("outbox")
+	published = new(expvar.Int)
+	failures  = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("published", published)
+	metrics.Set("failures", failures)
+}
+
+// Entry is a notification waiting to be published
+type Entry struct {
+	TxID         string    `json:"tx_id"`
+	Source       string    `json:"source"`
+	SurveyID     string    `json:"survey_id"`
+	InstrumentID string    `json:"instrument_id"`
+	Period       string    `json:"period,omitempty"`
+	ExerciseSID  string    `json:"exercise_sid,omitempty"`
+	ReceivedAt   time.Time `json:"received_at,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	Attempts     int       `json:"attempts"`
+	LastAttempt  time.Time `json:"last_attempt,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// PublishFunc publishes the notification for an entry. It should only
+// return nil once the broker has the message.
+type PublishFunc func(Entry) error
+
+// Outbox is a durable, file backed store of pending entries. It is safe for
+// concurrent use.
+type Outbox struct {
+	db *bolt.DB
+}
+
+// Open opens (creating if needed) the outbox file at the given path
+func Open(path string) (*Outbox, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	o := &Outbox{db: db}
+	metrics.Set("pending", expvar.Func(func() interface{} {
+		n, _ := o.count()
+		return n
+	}))
+	return o, nil
+}
+
+// Close closes the underlying file
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// Add durably records an entry. When it returns nil the entry has been
+// synced to disk.
+func (o *Outbox) Add(e Entry) error {
+	if len(e.TxID) == 0 {
+		return errors.New("entry has no tx_id")
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	return o.put(e)
+}
+
+// Remove deletes the entry for a tx_id, once its notification is published
+func (o *Outbox) Remove(txID string) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(txID))
+	})
+}
+
+// Pending returns every entry still waiting to be published, ordered by
+// tx_id.
+func (o *Outbox) Pending() ([]Entry, error) {
+	entries := []Entry{}
+	err := o.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// StartRelay starts a goroutine that tries to publish pending entries at the
+// given interval. Entries younger than the interval are left alone to give
+// the request that created them the first go at publishing. Returns a cancel
+// function to stop the goroutine.
+func (o *Outbox) StartRelay(interval time.Duration, publish PublishFunc) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	log.Printf(`event="Starting outbox relay" interval="%s"`, interval)
+
+	go func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Print(`event="Canceling outbox relay"`)
+				return
+			case <-ticker.C:
+				if err := o.relay(time.Now().Add(-interval), publish); err != nil {
+					log.Printf(`event="Outbox relay failed" error="%v"`, err)
+				}
+			}
+		}
+	}(ctx)
+
+	return cancel
+}
+
+// relay makes one pass over the pending entries created before the given
+// time. A failure to publish one entry is recorded against it and the pass
+// carries on with the rest, so one bad entry doesn't hold up the others.
+func (o *Outbox) relay(before time.Time, publish PublishFunc) error {
+	entries, err := o.Pending()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.CreatedAt.After(before) {
+			continue
+		}
+
+		if err = publish(e); err != nil {
+			failures.Add(1)
+			log.Printf(`event="Outbox relay failed to publish" tx_id="%s" attempts="%d" error="%v"`, e.TxID, e.Attempts+1, err)
+			if err = o.recordFailure(e.TxID, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		published.Add(1)
+		log.Printf(`event="Outbox relay published notification" tx_id="%s" attempts="%d"`, e.TxID, e.Attempts+1)
+		if err = o.Remove(e.TxID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordFailure records a failed attempt to publish against an entry. If the
+// entry has gone in the meantime - the request that added it published it
+// after all - it is left gone rather than being added back.
+func (o *Outbox) recordFailure(txID string, cause error) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		v := b.Get([]byte(txID))
+		if v == nil {
+			return nil
+		}
+
+		var e Entry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		e.Attempts++
+		e.LastAttempt = time.Now().UTC()
+		e.LastError = cause.Error()
+
+		value, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(txID), value)
+	})
+}
+
+func (o *Outbox) put(e Entry) error {
+	value, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(e.TxID), value)
+	})
+}
+
+func (o *Outbox) count() (int, error) {
+	n := 0
+	err := o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,74 @@
+package outbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutboxRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := Open(filepath.Join(dir, "outbox.db"))
+	if err != nil {
+		t.Fatalf("Expected no error opening outbox, got %v", err)
+	}
+	defer o.Close()
+
+	for _, id := range []string{"a", "b"} {
+		if err = o.Add(Entry{TxID: id, Source: "eq", SurveyID: "023", InstrumentID: "0203"}); err != nil {
+			t.Fatalf("Expected no error adding entry, got %v", err)
+		}
+	}
+
+	// Broker down - entry stays pending with the failure recorded
+	err = o.relay(time.Now(), func(Entry) error { return errors.New("broker down") })
+	if err != nil {
+		t.Fatalf("Expected no error from relay pass, got %v", err)
+	}
+	pending, _ := o.Pending()
+	if len(pending) != 2 || pending[0].Attempts != 1 || pending[1].Attempts != 1 || pending[0].LastError != "broker down" {
+		t.Errorf("Expected failed attempt recorded against every entry, got %+v", pending)
+	}
+
+	// The request that added an entry publishes and removes it while the
+	// relay's own attempt fails - it mustn't come back to be published twice
+	err = o.relay(time.Now(), func(e Entry) error {
+		if e.TxID == "a" {
+			o.Remove("a")
+		}
+		return errors.New("broker down")
+	})
+	if err != nil {
+		t.Fatalf("Expected no error from relay pass, got %v", err)
+	}
+	if pending, _ = o.Pending(); len(pending) != 1 || pending[0].TxID != "b" || pending[0].Attempts != 2 {
+		t.Errorf("Expected only b to be left pending, got %+v", pending)
+	}
+
+	// Entries newer than the cut off are left alone
+	o.relay(time.Now().Add(-time.Hour), func(Entry) error {
+		t.Error("Expected new entries to be skipped")
+		return nil
+	})
+
+	// Broker back - everything is published and removed
+	var sent []string
+	o.relay(time.Now(), func(e Entry) error {
+		sent = append(sent, e.TxID)
+		return nil
+	})
+	if len(sent) != 1 {
+		t.Errorf("Expected 1 entry published, got %v", sent)
+	}
+	if pending, _ = o.Pending(); len(pending) != 0 {
+		t.Errorf("Expected empty outbox, got %+v", pending)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/outbox"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/store"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
+)
+
+// submitSurvey runs a single piece of posted (encrypted) survey data through
+// the whole pipeline. It returns the tx_id (if it got far enough to know it)
+// along with either the success status or the problem to report.
+func submitSurvey(ctx context.Context, data []byte) (string, int, *api.Problem) {
+	survey, body, problem := parseSubmission(data)
+	if problem == nil {
+		problem = checkOrigin(ctx, survey)
+	}
+	if problem != nil {
+		return "", 0, problem
+	}
+	status, problem := processSubmission(ctx, survey, body)
+	return survey.TxID, status, problem
+}
+
+// parseSubmission decrypts, verifies, parses and validates posted survey
+// data. On success it returns the parsed survey and the decrypted JSON.
+func parseSubmission(data []byte) (*Survey, []byte, *api.Problem) {
+
+	// Decrypt and verify - anything that fails here never gets near the
+	// store or the notify exchange.
+	body, err := decryptSurvey(data)
+	if err != nil {
+		log.Printf(`event="Failed to decrypt posted data" error="%v"`, err)
+		problem := decryptionProblem(err)
+		return nil, nil, &problem
+	}
+
+	survey := Survey{ReceivedAt: time.Now().UTC()}
+	if err := json.Unmarshal(body, &survey); err != nil {
+		log.Printf(`event="Failed to parse survey JSON" error="%v"`, err)
+		return nil, nil, &api.Problem{
+			Title:  "Failed to parse survey JSON",
+			Status: http.StatusBadRequest,
+		}
+	}
+	log.Printf(
+		`event="Received survey data" survey_id="%s" instrument_id="%s" tx_id="%v"`,
+		survey.SurveyID,
+		survey.Collection.InstrumentID,
+		survey.TxID,
+	)
+
+	// Validate against the schema for this survey/instrument so malformed
+	// data is caught here rather than downstream
+	if problem := validateSurvey(survey, body); problem != nil {
+		log.Printf(`event="Survey failed validation" tx_id="%s" title="%s"`, survey.TxID, problem.Title)
+		return nil, nil, problem
+	}
+
+	if problem := checkTxID(survey.TxID); problem != nil {
+		log.Printf(`event="Survey has no valid tx_id" tx_id="%s"`, survey.TxID)
+		return nil, nil, problem
+	}
+
+	return &survey, body, nil
+}
+
+// checkTxID returns the problem to report for a missing or malformed tx_id,
+// or nil if it's fine to use
+func checkTxID(txID string) *api.Problem {
+	if len(txID) == 0 {
+		return &api.Problem{
+			Title:  "Missing tx_id",
+			Status: http.StatusBadRequest,
+		}
+	}
+	if !txIDPattern.MatchString(txID) {
+		return &api.Problem{
+			Title:  "Invalid tx_id",
+			Status: http.StatusBadRequest,
+			Detail: "A tx_id must be a UUID in lower case",
+		}
+	}
+	return nil
+}
+
+// processSubmission takes a parsed and validated survey and:
+//   - claims its tx_id (or answers a replay)
+//   - stores the survey into the datastore (via service)
+//   - places a notification of the event onto the notify exchange
+//
+// It returns either the success status or the problem to report.
+func processSubmission(ctx context.Context, survey *Survey, body []byte) (int, *api.Problem) {
+	hash, previous, problem := claimSubmission(survey, body)
+	if problem != nil {
+		return 0, problem
+	}
+	if previous != nil {
+		return replayResult(survey, hash, previous)
+	}
+
+	if problem = deliverSubmission(ctx, survey, body); problem != nil {
+		abandonTx(survey.TxID)
+		return 0, problem
+	}
+
+	finishSubmission(survey, hash)
+	return http.StatusOK, nil
+}
+
+// claimSubmission checks whether we've already seen this tx_id. eQ will
+// retry if it doesn't hear back from us and a replay mustn't be stored or
+// notified a second time. It returns the hash of the body along with the
+// record of the earlier submission if this is a replay.
+func claimSubmission(survey *Survey, body []byte) (string, *txRecord, *api.Problem) {
+	hash := hashSurvey(body)
+	previous, err := claimTx(survey.TxID, hash)
+	if err != nil {
+		log.Printf(`event="Failed to check tx_id" tx_id="%s" error="%v"`, survey.TxID, err)
+		return "", nil, &api.Problem{
+			Title:  "Unable to accept survey at this time",
+			Status: http.StatusServiceUnavailable,
+			Detail: "Could not check for a previous submission with this tx_id",
+		}
+	}
+	if previous == nil {
+		stages.Record(survey.TxID, tracker.Received, "")
+	}
+	return hash, previous, nil
+}
+
+// replayResult gives the answer for a replayed tx_id
+func replayResult(survey *Survey, hash string, previous *txRecord) (int, *api.Problem) {
+	switch {
+	case previous.Hash != hash:
+		log.Printf(`event="Conflicting replay of tx_id" tx_id="%s"`, survey.TxID)
+		return 0, &api.Problem{
+			Title:  "Conflicting submission",
+			Status: http.StatusConflict,
+			Detail: "A different submission has already been received with this tx_id",
+		}
+	case previous.Status == 0:
+		log.Printf(`event="Replay of tx_id still in progress" tx_id="%s"`, survey.TxID)
+		return 0, &api.Problem{
+			Title:  "Submission in progress",
+			Status: http.StatusConflict,
+			Detail: "This submission is still being processed - retry later",
+		}
+	}
+	log.Printf(`event="Replay of tx_id - returning original result" tx_id="%s" status="%d"`, survey.TxID, previous.Status)
+	return previous.Status, nil
+}
+
+// deliverSubmission stores a claimed survey and makes sure its notification
+// will be published. It returns the problem to report if it fails, in which
+// case it is safe to try again.
+func deliverSubmission(ctx context.Context, survey *Survey, body []byte) *api.Problem {
+
+	// Fire to data store
+	log.Printf(`event="Attempting to store survey data" tx_id="%s"`, survey.TxID)
+	if err := storeClient.Store(ctx, body); err != nil {
+		log.Printf(`event="Failed to store survey JSON" tx_id="%s" error="%v"`, survey.TxID, err)
+		problem := storeProblem(err)
+		return &problem
+	}
+	stages.Record(survey.TxID, tracker.Stored, "")
+
+	return queueNotification(survey, "eq")
+}
+
+// queueNotification makes sure the notification for a stored survey will be
+// published, giving the problem to report if it can't.
+func queueNotification(survey *Survey, source string) *api.Problem {
+
+	// Record the notification durably before attempting to publish it. Once
+	// this succeeds the survey is safely on its way - if the publish below
+	// fails the outbox relay will keep retrying until it gets through.
+	entry := outbox.Entry{
+		TxID:         survey.TxID,
+		Source:       source,
+		SurveyID:     survey.SurveyID,
+		InstrumentID: survey.Collection.InstrumentID,
+		Period:       survey.Collection.Period,
+		ExerciseSID:  survey.Collection.ExerciseSID,
+		ReceivedAt:   survey.ReceivedAt,
+	}
+	if err := notifyOutbox.Add(entry); err != nil {
+		log.Printf(`event="Failed to add notification to outbox" tx_id="%s" error="%v"`, survey.TxID, err)
+		return &api.Problem{
+			Title:  "Failed to notify request",
+			Status: http.StatusInternalServerError,
+			Detail: "Unable to route survey receipt notification at this time",
+		}
+	}
+
+	// Notify
+	log.Printf(`event="Attempting to publish notification" tx_id="%s"`, survey.TxID)
+	if err := publishEntry(entry); err != nil {
+		log.Printf(`event="Failed to publish survey notification event - left for outbox relay" tx_id="%s" error="%v"`, survey.TxID, err)
+	} else if err = notifyOutbox.Remove(survey.TxID); err != nil {
+		// The relay will publish it again - consumers have to cope with
+		// duplicate notifications anyway
+		log.Printf(`event="Failed to remove notification from outbox" tx_id="%s" error="%v"`, survey.TxID, err)
+	}
+	return nil
+}
+
+// storeProblem maps an error from the store client to the problem response
+// we want to give to the client. A conflict or not found from the store is
+// passed on as it is - none of the rest are the client's fault.
+func storeProblem(err error) api.Problem {
+	var statusErr *store.StatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict:
+		return api.Problem{
+			Title:  "Conflicting submission",
+			Status: http.StatusConflict,
+			Detail: "A different submission is already stored with this tx_id",
+		}
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+		return api.Problem{
+			Title:  "Not found",
+			Status: http.StatusNotFound,
+			Detail: "The store responded with 404 Not Found",
+		}
+	case errors.Is(err, store.ErrCircuitOpen):
+		return api.Problem{
+			Title:  "Store unavailable",
+			Status: http.StatusServiceUnavailable,
+			Detail: "The store has been failing and is not being called for a short while - retry later",
+		}
+	case errors.Is(err, store.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return api.Problem{
+			Title:  "Store unavailable",
+			Status: http.StatusServiceUnavailable,
+			Detail: "The store could not be reached in time - retry later",
+		}
+	case errors.As(err, &statusErr):
+		return api.Problem{
+			Title:  "Failed to store survey JSON",
+			Status: http.StatusBadGateway,
+			Detail: fmt.Sprintf("The store responded with %s", statusErr.Status),
+		}
+	}
+	return api.Problem{
+		Title:  "Failed to store survey JSON",
+		Status: http.StatusBadGateway,
+	}
+}
+
+// finishSubmission records the successful result for a tx_id so any replay
+// gets the same answer.
+func finishSubmission(survey *Survey, hash string) {
+	if err := completeTx(survey.TxID, hash, http.StatusOK); err != nil {
+		// Not fatal - we've done the work, the worst case is that a replay
+		// after the claim lapses is processed again, which the store
+		// accepts as the same submission.
+		log.Printf(`event="Failed to record tx_id result" tx_id="%s" error="%v"`, survey.TxID, err)
+	}
+}
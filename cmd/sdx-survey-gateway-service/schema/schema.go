@@ -0,0 +1,143 @@
+// Package schema provides a registry of JSON Schemas used to validate
+// submitted survey data, keyed by survey_id and instrument_id.
+//
+// Schemas are loaded from a directory laid out as:
+//
+//	<dir>/<survey_id>/<instrument_id>.json
+//
+// e.g. <dir>/023/0203.json for MBS instrument 0203. Files at the top level
+// are shared parts, which a schema can refer to by a relative $ref, e.g.
+// "../submission.json" for the envelope every survey shares.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ErrUnknownSchema is returned when no schema is registered for the given
+// survey and instrument.
+var ErrUnknownSchema = errors.New("no schema registered")
+
+// Violation describes a single part of a document that failed validation
+type Violation struct {
+	Pointer string // RFC6901 JSON pointer to the failing element
+	Reason  string
+}
+
+// Registry holds the compiled schemas. It is safe for concurrent use once
+// loaded.
+type Registry struct {
+	schemas map[string]*gojsonschema.Schema
+}
+
+// Load compiles every schema found in the given directory
+func Load(dir string) (*Registry, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema directory: %v", err)
+	}
+	surveys, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema directory: %v", err)
+	}
+
+	r := &Registry{schemas: make(map[string]*gojsonschema.Schema)}
+
+	for _, s := range surveys {
+		if !s.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, s.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema directory: %v", err)
+		}
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+				continue
+			}
+			// Loaded by reference so that a relative $ref resolves against
+			// the file
+			path := filepath.Join(dir, s.Name(), f.Name())
+			ref := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+			compiled, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader(ref))
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile schema [%s]: %v", path, err)
+			}
+			r.schemas[key(s.Name(), strings.TrimSuffix(f.Name(), ".json"))] = compiled
+		}
+	}
+
+	log.Printf(`event="Loaded schema registry" dir="%s" schemas="%d"`, dir, len(r.schemas))
+	return r, nil
+}
+
+// Validate checks a document against the schema registered for the given
+// survey and instrument. A nil slice with a nil error means the document is
+// valid.
+func (r *Registry) Validate(surveyID, instrumentID string, document []byte) ([]Violation, error) {
+	s, ok := r.schemas[key(surveyID, instrumentID)]
+	if !ok {
+		return nil, fmt.Errorf("%w: survey_id=%s instrument_id=%s", ErrUnknownSchema, surveyID, instrumentID)
+	}
+
+	result, err := s.Validate(gojsonschema.NewBytesLoader(document))
+	if err != nil {
+		return nil, err
+	}
+	if result.Valid() {
+		return nil, nil
+	}
+
+	violations := make([]Violation, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		p := pointer(e.Context())
+		switch e.Type() {
+		case "number_all_of", "number_any_of", "number_one_of":
+			// Only says that parts failed - they are reported themselves
+			continue
+		case "required":
+			// Reported against the object - point at the missing property
+			if property, ok := e.Details()["property"].(string); ok {
+				p += "/" + escape.Replace(property)
+			}
+		}
+		violations = append(violations, Violation{
+			Pointer: p,
+			Reason:  e.Description(),
+		})
+	}
+	return violations, nil
+}
+
+func key(surveyID, instrumentID string) string {
+	return surveyID + "/" + instrumentID
+}
+
+// escape escapes a property name for a JSON pointer as per RFC6901
+var escape = strings.NewReplacer("~", "~0", "/", "~1")
+
+// pointer converts a gojsonschema context (e.g. "(root).collection.period")
+// into a JSON pointer (e.g. "/collection/period"), escaping as per RFC6901.
+func pointer(ctx *gojsonschema.JsonContext) string {
+	if ctx == nil {
+		return ""
+	}
+	// Use a delimiter that can't appear in a property name so we can split
+	// safely. The first element is always "(root)".
+	parts := strings.Split(ctx.String("\x00"), "\x00")[1:]
+
+	var b strings.Builder
+	for _, p := range parts {
+		b.WriteString("/")
+		b.WriteString(escape.Replace(p))
+	}
+	return b.String()
+}
@@ -0,0 +1,76 @@
+package schema
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testEnvelope = `{
+	"type": "object",
+	"required": ["tx_id", "collection"],
+	"properties": {
+		"collection": {
+			"type": "object",
+			"properties": {
+				"period": {"type": "string", "pattern": "^[0-9]{6}$"}
+			}
+		}
+	}
+}`
+
+const testSchema = `{
+	"allOf": [{"$ref": "../envelope.json"}],
+	"properties": {
+		"collection": {
+			"properties": {
+				"instrument_id": {"const": "0203"}
+			}
+		}
+	}
+}`
+
+func TestRegistryValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "023"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "023", "0203.json"), []byte(testSchema), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "envelope.json"), []byte(testEnvelope), 0600)
+
+	r, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Expected no error loading registry, got %v", err)
+	}
+
+	violations, err := r.Validate("023", "0203", []byte(`{"tx_id":"1","collection":{"instrument_id":"0203","period":"201710"}}`))
+	if err != nil || len(violations) != 0 {
+		t.Errorf("Expected valid document, got %v (%v)", violations, err)
+	}
+
+	// Violations of the shared envelope are reported too, each against
+	// the element at fault
+	violations, err = r.Validate("023", "0203", []byte(`{"collection":{"instrument_id":"0205","period":"2017"}}`))
+	if err != nil {
+		t.Fatalf("Expected no error validating, got %v", err)
+	}
+	if len(violations) != 3 {
+		t.Fatalf("Expected 3 violations, got %v", violations)
+	}
+	pointers := map[string]bool{}
+	for _, v := range violations {
+		pointers[v.Pointer] = true
+	}
+	if !pointers["/tx_id"] || !pointers["/collection/period"] || !pointers["/collection/instrument_id"] {
+		t.Errorf("Expected violations at /tx_id, /collection/period and /collection/instrument_id, got %v", violations)
+	}
+
+	if _, err = r.Validate("023", "9999", []byte(`{}`)); !errors.Is(err, ErrUnknownSchema) {
+		t.Errorf("Expected ErrUnknownSchema for unregistered instrument, got %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
+)
+
+const (
+	// Names of the form parts in a SEFT submission
+	seftMetadataPart = "metadata"
+	seftFilePart     = "file"
+
+	// seftMaxMetadata is the most metadata JSON we'll read
+	seftMaxMetadata = 64 * 1024
+
+	// seftMultipartOverhead allows for the boundaries and part headers when
+	// limiting the size of a whole SEFT request
+	seftMultipartOverhead = 16 * 1024
+)
+
+var (
+	// seftMaxBytes is the largest attachment we'll accept
+	seftMaxBytes int64
+
+	// seftContentTypes holds the media types we'll accept for an attachment
+	seftContentTypes map[string]bool
+)
+
+// SEFTMetadata describes a SEFT (spreadsheet) return
+type SEFTMetadata struct {
+	TxID         string `json:"tx_id"`
+	SurveyID     string `json:"survey_id"`
+	InstrumentID string `json:"instrument_id"`
+	Period       string `json:"period"`
+	RuRef        string `json:"ru_ref"`
+	ExerciseSID  string `json:"exercise_sid,omitempty"`
+	Origin       string `json:"origin,omitempty"`
+}
+
+// seftSubmission is a SEFT return as read from the request
+type seftSubmission struct {
+	Metadata    SEFTMetadata
+	RawMetadata []byte
+	Filename    string
+	ContentType string
+	File        []byte
+}
+
+// PostedSEFTHandler takes a SEFT return posted as multipart/form-data - a
+// "metadata" part holding JSON and a "file" part holding the spreadsheet -
+// stores both and publishes a notification with the source "seft".
+//
+// Submissions are claimed by tx_id in the same way as survey JSON, so a
+// replay gets the original result. SEFT returns are always processed
+// synchronously.
+func PostedSEFTHandler(rw http.ResponseWriter, r *http.Request) {
+	sub, problem := readSEFT(r, seftMaxBytes, seftContentTypes)
+	if problem != nil {
+		api.WriteProblemResponse(*problem, rw)
+		return
+	}
+
+	log.Printf(
+		`event="Received SEFT return" tx_id="%s" survey_id="%s" filename="%s" size="%d"`,
+		sub.Metadata.TxID,
+		sub.Metadata.SurveyID,
+		sub.Filename,
+		len(sub.File),
+	)
+
+	survey := &Survey{
+		TxID:     sub.Metadata.TxID,
+		Type:     "seft",
+		Origin:   sub.Metadata.Origin,
+		SurveyID: sub.Metadata.SurveyID,
+		Collection: Collection{
+			ExerciseSID:  sub.Metadata.ExerciseSID,
+			InstrumentID: sub.Metadata.InstrumentID,
+			Period:       sub.Metadata.Period,
+		},
+		ReceivedAt: time.Now().UTC(),
+	}
+	if problem = checkOrigin(r.Context(), survey); problem != nil {
+		api.WriteProblemResponse(*problem, rw)
+		return
+	}
+
+	// The attachment can be large, so the replay check compares a digest of
+	// the parts rather than the parts themselves
+	digest := []byte(hashSurvey(sub.RawMetadata) + hashSurvey(sub.File))
+	hash, previous, problem := claimSubmission(survey, digest)
+	if problem != nil {
+		api.WriteProblemResponse(*problem, rw)
+		return
+	}
+	if previous != nil {
+		status, problem := replayResult(survey, hash, previous)
+		if problem != nil {
+			api.WriteProblemResponse(*problem, rw)
+			return
+		}
+		rw.WriteHeader(status)
+		return
+	}
+
+	if problem = deliverSEFT(r.Context(), survey, sub); problem != nil {
+		abandonTx(survey.TxID)
+		api.WriteProblemResponse(*problem, rw)
+		return
+	}
+
+	finishSubmission(survey, hash)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// deliverSEFT stores a claimed SEFT return and makes sure its notification
+// will be published
+func deliverSEFT(ctx context.Context, survey *Survey, sub *seftSubmission) *api.Problem {
+	log.Printf(`event="Attempting to store SEFT return" tx_id="%s"`, survey.TxID)
+	if err := storeClient.StoreSEFT(ctx, sub.RawMetadata, sub.Filename, sub.ContentType, sub.File); err != nil {
+		log.Printf(`event="Failed to store SEFT return" tx_id="%s" error="%v"`, survey.TxID, err)
+		problem := storeProblem(err)
+		return &problem
+	}
+	stages.Record(survey.TxID, tracker.Stored, "")
+
+	return queueNotification(survey, "seft")
+}
+
+// readSEFT reads and checks the parts of a SEFT submission, enforcing the
+// size and media type limits on the attachment
+func readSEFT(r *http.Request, maxBytes int64, contentTypes map[string]bool) (*seftSubmission, *api.Problem) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return nil, &api.Problem{
+			Title:  "Unsupported media type",
+			Status: http.StatusUnsupportedMediaType,
+			Detail: "A SEFT return must be posted as multipart/form-data",
+		}
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, badSEFT(err.Error())
+	}
+
+	sub := &seftSubmission{}
+	var haveMetadata, haveFile bool
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf(`event="Failed to read SEFT return" error="%v"`, err)
+			return nil, badSEFT("The multipart body could not be read")
+		}
+
+		switch name := part.FormName(); {
+		case name == seftMetadataPart && !haveMetadata:
+			haveMetadata = true
+			if sub.RawMetadata, err = readLimited(part, seftMaxMetadata); err != nil {
+				return nil, readProblem(err, "metadata", seftMaxMetadata)
+			}
+
+		case name == seftFilePart && !haveFile:
+			haveFile = true
+			sub.Filename = part.FileName()
+			sub.ContentType, _, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if !contentTypes[sub.ContentType] {
+				return nil, &api.Problem{
+					Title:  "Unsupported attachment type",
+					Status: http.StatusUnsupportedMediaType,
+					Detail: fmt.Sprintf("Attachments of type %q are not accepted", sub.ContentType),
+				}
+			}
+			if sub.File, err = readLimited(part, maxBytes); err != nil {
+				return nil, readProblem(err, "attachment", maxBytes)
+			}
+
+		default:
+			return nil, badSEFT(fmt.Sprintf("Unexpected or repeated part %q", name))
+		}
+		part.Close()
+	}
+
+	var invalid []api.InvalidParam
+	if !haveMetadata {
+		invalid = append(invalid, api.InvalidParam{Name: seftMetadataPart, Reason: "is required"})
+	}
+	if !haveFile || len(sub.File) == 0 {
+		invalid = append(invalid, api.InvalidParam{Name: seftFilePart, Reason: "is required"})
+	}
+	if haveMetadata {
+		if err := json.Unmarshal(sub.RawMetadata, &sub.Metadata); err != nil {
+			invalid = append(invalid, api.InvalidParam{Name: seftMetadataPart, Reason: "is not valid JSON"})
+		} else {
+			invalid = append(invalid, sub.Metadata.invalid()...)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, &api.Problem{
+			Title:         "Invalid SEFT return",
+			Status:        http.StatusBadRequest,
+			InvalidParams: invalid,
+		}
+	}
+
+	if len(sub.Filename) == 0 {
+		sub.Filename = sub.Metadata.TxID
+	}
+	return sub, nil
+}
+
+// invalid lists the required metadata that hasn't been given, and a tx_id
+// that isn't fit to use
+func (m SEFTMetadata) invalid() []api.InvalidParam {
+	var invalid []api.InvalidParam
+	for _, field := range []struct{ name, value string }{
+		{"tx_id", m.TxID},
+		{"survey_id", m.SurveyID},
+		{"instrument_id", m.InstrumentID},
+		{"period", m.Period},
+		{"ru_ref", m.RuRef},
+	} {
+		if len(strings.TrimSpace(field.value)) == 0 {
+			invalid = append(invalid, api.InvalidParam{
+				Name:   seftMetadataPart + "." + field.name,
+				Reason: "is required",
+			})
+		}
+	}
+	if len(m.TxID) > 0 && checkTxID(m.TxID) != nil {
+		invalid = append(invalid, api.InvalidParam{
+			Name:   seftMetadataPart + ".tx_id",
+			Reason: "must be a UUID in lower case",
+		})
+	}
+	return invalid
+}
+
+var errTooLarge = errors.New("too large")
+
+// readLimited reads all of r, failing with errTooLarge if it holds more than
+// max bytes
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
+
+func readProblem(err error, what string, max int64) *api.Problem {
+	if errors.Is(err, errTooLarge) {
+		return &api.Problem{
+			Title:  "Request entity too large",
+			Status: http.StatusRequestEntityTooLarge,
+			Detail: fmt.Sprintf("The %s may be at most %d bytes", what, max),
+		}
+	}
+	log.Printf(`event="Failed to read SEFT return" part="%s" error="%v"`, what, err)
+	return badSEFT(fmt.Sprintf("The %s could not be read", what))
+}
+
+func badSEFT(detail string) *api.Problem {
+	return &api.Problem{
+		Title:  "Unable to read SEFT return",
+		Status: http.StatusBadRequest,
+		Detail: detail,
+	}
+}
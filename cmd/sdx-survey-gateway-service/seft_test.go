@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/origins"
+)
+
+// seftRequest builds a multipart SEFT request with the given metadata and
+// file parts. An empty contentType leaves the part out.
+func seftRequest(t *testing.T, metadata, contentType string, file []byte) *http.Request {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if len(metadata) > 0 {
+		w.WriteField("metadata", metadata)
+	}
+	if len(contentType) > 0 {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="return.csv"`)
+		h.Set("Content-Type", contentType)
+		part, err := w.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(file)
+	}
+	w.Close()
+
+	r := httptest.NewRequest("POST", "/seft", &body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+func TestReadSEFT(t *testing.T) {
+	allowed := map[string]bool{"text/csv": true}
+	metadata := `{"tx_id":"0f534ffc-9442-414c-b39f-a756b4adc6cb","survey_id":"023","instrument_id":"0203","period":"201605","ru_ref":"12345678901A"}`
+
+	sub, problem := readSEFT(seftRequest(t, metadata, "text/csv", []byte("a,b\n1,2\n")), 16, allowed)
+	if problem != nil {
+		t.Fatalf("Expected SEFT return to be read, got %+v", *problem)
+	}
+	if sub.Metadata.TxID != "0f534ffc-9442-414c-b39f-a756b4adc6cb" || sub.Filename != "return.csv" || sub.ContentType != "text/csv" || string(sub.File) != "a,b\n1,2\n" {
+		t.Errorf("Unexpected SEFT return %+v", *sub)
+	}
+
+	for name, test := range map[string]struct {
+		r        *http.Request
+		expected int
+	}{
+		"too large":        {seftRequest(t, metadata, "text/csv", []byte(strings.Repeat("a", 17))), http.StatusRequestEntityTooLarge},
+		"wrong type":       {seftRequest(t, metadata, "application/pdf", []byte("%PDF")), http.StatusUnsupportedMediaType},
+		"missing file":     {seftRequest(t, metadata, "", nil), http.StatusBadRequest},
+		"missing metadata": {seftRequest(t, "", "text/csv", []byte("a")), http.StatusBadRequest},
+		"missing ru_ref":   {seftRequest(t, `{"tx_id":"0f534ffc-9442-414c-b39f-a756b4adc6cb","survey_id":"023","instrument_id":"0203","period":"201605"}`, "text/csv", []byte("a")), http.StatusBadRequest},
+		"invalid tx_id":    {seftRequest(t, `{"tx_id":"../abc","survey_id":"023","instrument_id":"0203","period":"201605","ru_ref":"12345678901A"}`, "text/csv", []byte("a")), http.StatusBadRequest},
+		"not multipart":    {httptest.NewRequest("POST", "/seft", strings.NewReader("{}")), http.StatusUnsupportedMediaType},
+	} {
+		_, problem := readSEFT(test.r, 16, allowed)
+		if problem == nil || problem.Status != test.expected {
+			t.Errorf("Expected %d for %s, got %+v", test.expected, name, problem)
+		}
+	}
+}
+
+func TestPostedSEFTOrigin(t *testing.T) {
+	seftMaxBytes, seftContentTypes = 16, map[string]bool{"text/csv": true}
+
+	// A return claiming to be from another origin is refused before its
+	// tx_id is claimed
+	r := seftRequest(t, `{"tx_id":"0f534ffc-9442-414c-b39f-a756b4adc6cb","survey_id":"023","instrument_id":"0203","period":"201605","ru_ref":"12345678901A","origin":"other"}`, "text/csv", []byte("a"))
+	r = r.WithContext(context.WithValue(r.Context(), originKey{}, &origins.Origin{Name: "seft"}))
+	rw := httptest.NewRecorder()
+	PostedSEFTHandler(rw, r)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a return from another origin, got %d %s", rw.Code, rw.Body)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
+
+	"github.com/gorilla/mux"
+)
+
+// stages records and reports where submissions have got to in the pipeline
+var stages *tracker.Tracker
+
+// SurveyStatusHandler reports the lifecycle of a submission as recorded by
+// each of the services it has passed through.
+func SurveyStatusHandler(rw http.ResponseWriter, r *http.Request) {
+	txID := mux.Vars(r)["tx_id"]
+
+	status, err := stages.Status(txID)
+	if err != nil {
+		log.Printf(`event="Failed to get status" tx_id="%s" error="%v"`, txID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to get submission status",
+			Status: http.StatusServiceUnavailable,
+		}, rw)
+		return
+	}
+	if status == nil {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Submission not found",
+			Status: http.StatusNotFound,
+			Detail: "Nothing has been recorded for this tx_id",
+		}, rw)
+		return
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		log.Printf(`event="Failed to marshal status" tx_id="%s" error="%v"`, txID, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Unable to get submission status",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
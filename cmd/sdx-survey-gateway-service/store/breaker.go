@@ -0,0 +1,68 @@
+package store
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// breaker is a simple consecutive-failure circuit breaker. Once threshold
+// attempts in a row have failed it opens and refuses calls for the cooldown
+// period. After that a single trial call is let through (half-open) - if it
+// succeeds the breaker closes, otherwise it opens again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // a half-open trial call is in flight
+}
+
+// allow reports whether a call may be made
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// release notes that a call made after allow ended without telling us
+// whether the store is healthy, e.g. a 4xx response. It isn't counted either
+// way, but lets another half-open trial through.
+func (b *breaker) release() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+// record notes the outcome of a call made after allow
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if success {
+		if b.failures >= b.threshold {
+			log.Print(`event="Store circuit breaker closed"`)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Printf(`event="Store circuit breaker opened" cooldown="%s"`, b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
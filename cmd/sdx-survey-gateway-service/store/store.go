@@ -0,0 +1,237 @@
+// Package store is the gateway's client for the store service. It bounds
+// every call with a deadline, retries transient failures (network errors and
+// 5xx responses) with jittered exponential backoff, and stops calling a
+// store that keeps failing via a circuit breaker. A 4xx response or the
+// caller giving up isn't the store failing, so neither is retried or counted
+// by the breaker.
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen is returned without calling the store while the circuit
+	// breaker is open
+	ErrCircuitOpen = errors.New("store circuit breaker open")
+
+	// ErrUnavailable is returned when the store could not be reached (or
+	// didn't answer in time) after every attempt
+	ErrUnavailable = errors.New("store unavailable")
+)
+
+// StatusError is returned when the store answers with a status other than
+// 200 OK
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad response from store: %s", e.Status)
+}
+
+// Options controls the behaviour of a Client. Zero values are replaced with
+// the defaults shown.
+type Options struct {
+	Timeout          time.Duration // Overall deadline for a call, including retries (10s)
+	AttemptTimeout   time.Duration // Deadline for a single attempt (3s)
+	MaxAttempts      int           // Attempts before giving up (3)
+	Backoff          time.Duration // Base delay before a retry, doubled each time and jittered (100ms)
+	BreakerThreshold int           // Consecutive failed attempts that open the breaker (5)
+	BreakerCooldown  time.Duration // Time the breaker stays open before a trial call (30s)
+}
+
+func (o *Options) setDefaults() {
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.AttemptTimeout == 0 {
+		o.AttemptTimeout = 3 * time.Second
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 3
+	}
+	if o.Backoff == 0 {
+		o.Backoff = 100 * time.Millisecond
+	}
+	if o.BreakerThreshold == 0 {
+		o.BreakerThreshold = 5
+	}
+	if o.BreakerCooldown == 0 {
+		o.BreakerCooldown = 30 * time.Second
+	}
+}
+
+// Client talks to a store service. It is safe for concurrent use.
+type Client struct {
+	url     string
+	opts    Options
+	http    *http.Client
+	breaker *breaker
+}
+
+// New creates a client for the store service at the given base url
+func New(baseURL string, opts Options) *Client {
+	opts.setDefaults()
+	return &Client{
+		url:  baseURL,
+		opts: opts,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 20,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		breaker: &breaker{threshold: opts.BreakerThreshold, cooldown: opts.BreakerCooldown},
+	}
+}
+
+// Store posts survey JSON to the store. A nil error means the store has
+// accepted it.
+func (c *Client) Store(ctx context.Context, data []byte) error {
+	return c.post(ctx, "/survey", "application/json", data)
+}
+
+// StoreSEFT posts the metadata (JSON) and attachment of a SEFT submission to
+// the store as multipart/form-data. A nil error means the store has accepted
+// both.
+func (c *Client) StoreSEFT(ctx context.Context, metadata []byte, filename, contentType string, file []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="metadata"`)
+	h.Set("Content-Type", "application/json")
+	part, err := w.CreatePart(h)
+	if err == nil {
+		_, err = part.Write(metadata)
+	}
+	if err != nil {
+		return err
+	}
+
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+		"name":     "file",
+		"filename": filename,
+	}))
+	h.Set("Content-Type", contentType)
+	if part, err = w.CreatePart(h); err == nil {
+		_, err = part.Write(file)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.post(ctx, "/seft", w.FormDataContentType(), body.Bytes())
+}
+
+// post makes a call to the store, with retries and the circuit breaker
+func (c *Client) post(ctx context.Context, path, contentType string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	var err error
+	for attempt := 1; attempt <= c.opts.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			if err = sleep(ctx, c.backoff(attempt-1)); err != nil {
+				break
+			}
+		}
+
+		if !c.breaker.allow() {
+			return ErrCircuitOpen
+		}
+
+		var retry bool
+		retry, err = c.attempt(ctx, path, contentType, data)
+		switch {
+		case err == nil:
+			c.breaker.record(true)
+			return nil
+		case !retry:
+			c.breaker.release()
+			return err
+		case errors.Is(ctx.Err(), context.Canceled):
+			// The caller went away - says nothing about the store
+			c.breaker.release()
+			return ctx.Err()
+		}
+		c.breaker.record(false)
+		log.Printf(`event="Store attempt failed" attempt="%d" error="%v"`, attempt, err)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// attempt makes a single call to the store, reporting whether a failure is
+// worth retrying
+func (c *Client) attempt(ctx context.Context, path, contentType string, data []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.AttemptTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// Network error or deadline
+		return true, err
+	}
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	return resp.StatusCode >= 500, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// backoff gives the delay before the given retry - exponential with "full
+// jitter" so that many gateways retrying at once spread out
+func (c *Client) backoff(retry int) time.Duration {
+	max := c.opts.Backoff << uint(retry-1)
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreRetries(t *testing.T) {
+	var calls int32
+	status := http.StatusServiceUnavailable
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Fail the first call only
+		if atomic.AddInt32(&calls, 1) == 1 {
+			rw.WriteHeader(status)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, Options{Backoff: time.Millisecond})
+
+	// 5xx is retried
+	if err := c.Store(context.Background(), []byte(`{}`)); err != nil {
+		t.Errorf("Expected store to succeed on retry, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", calls)
+	}
+
+	// 4xx is not
+	calls, status = 0, http.StatusBadRequest
+	err := c.Store(context.Background(), []byte(`{}`))
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected StatusError 400, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+}
+
+func TestStoreCircuitBreaker(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, Options{
+		MaxAttempts:      2,
+		Backoff:          time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	})
+
+	if err := c.Store(context.Background(), []byte(`{}`)); err == nil {
+		t.Error("Expected error from failing store")
+	}
+	if err := c.Store(context.Background(), []byte(`{}`)); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen once threshold reached, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected no calls while breaker open, got %d in total", calls)
+	}
+}
+
+func TestStoreCircuitBreakerIgnores(t *testing.T) {
+	var calls int32
+	var status int32 = http.StatusInternalServerError
+	hung := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Query().Get("hang") == "true" {
+			<-hung
+			return
+		}
+		rw.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer ts.Close()
+	defer close(hung)
+
+	c := New(ts.URL, Options{
+		MaxAttempts:      1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	})
+
+	// One real failure
+	if err := c.Store(context.Background(), []byte(`{}`)); err == nil {
+		t.Fatal("Expected error from failing store")
+	}
+
+	// The store refusing the request isn't it failing - or it being healthy
+	atomic.StoreInt32(&status, http.StatusConflict)
+	for i := 0; i < 3; i++ {
+		var statusErr *StatusError
+		if err := c.Store(context.Background(), []byte(`{}`)); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusConflict {
+			t.Errorf("Expected StatusError 409, got %v", err)
+		}
+	}
+
+	// Nor is the caller giving up
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := c.post(ctx, "/survey?hang=true", "application/json", []byte(`{}`)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// So the second real failure is what opens the breaker
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	c.Store(context.Background(), []byte(`{}`))
+	if err := c.Store(context.Background(), []byte(`{}`)); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen after 2 failures, got %v", err)
+	}
+	if calls != 6 {
+		t.Errorf("Expected 6 calls, got %d", calls)
+	}
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, Options{AttemptTimeout: 10 * time.Millisecond, Backoff: time.Millisecond})
+	if err := c.Store(context.Background(), []byte(`{}`)); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable when store times out, got %v", err)
+	}
+}
+
+func TestStoreSEFT(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/seft" {
+			t.Errorf("Expected post to /seft, got %s", r.URL.Path)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatalf("Expected multipart body, got %v", err)
+		}
+		if r.FormValue("metadata") != `{"tx_id":"abc"}` {
+			t.Errorf("Expected metadata part, got %q", r.FormValue("metadata"))
+		}
+		f, h, err := r.FormFile("file")
+		if err != nil {
+			t.Fatalf("Expected file part, got %v", err)
+		}
+		defer f.Close()
+		if h.Filename != "return.xlsx" || h.Header.Get("Content-Type") != "text/csv" {
+			t.Errorf("Unexpected file part header %v", h.Header)
+		}
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, Options{})
+	if err := c.StoreSEFT(context.Background(), []byte(`{"tx_id":"abc"}`), "return.xlsx", "text/csv", []byte("a,b")); err != nil {
+		t.Errorf("Expected SEFT store to succeed, got %v", err)
+	}
+}
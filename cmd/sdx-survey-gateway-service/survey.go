@@ -1,5 +1,13 @@
 package main
 
+import (
+	"regexp"
+	"time"
+)
+
+// txIDPattern is what a tx_id must look like - a UUID, as eQ generates
+var txIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
 // Survey represents the key elements of a block of survey JSON that can be
 // processed by this service. It only attempts to map the common core elements
 // that should always be present no matter the survey type.
@@ -9,6 +17,10 @@ type Survey struct {
 	Origin     string     `json:"origin"`
 	SurveyID   string     `json:"survey_id"`
 	Collection Collection `json:"collection"`
+
+	// ReceivedAt is when the gateway was given the survey - not part of the
+	// survey JSON
+	ReceivedAt time.Time `json:"-"`
 }
 
 // Collection represents the collection part of a block of survey data
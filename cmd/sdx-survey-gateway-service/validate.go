@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/schema"
+	"github.com/ONSdigital/sdx-evolution/internal/api"
+)
+
+var schemas *schema.Registry
+
+// rejectUnknownSurveys is whether survey data with no schema registered for
+// it is refused rather than passed through unvalidated
+var rejectUnknownSurveys bool
+
+// validationResult is the response to a successful dry run
+type validationResult struct {
+	Valid        bool   `json:"valid"`
+	TxID         string `json:"tx_id"`
+	SurveyID     string `json:"survey_id"`
+	InstrumentID string `json:"instrument_id"`
+}
+
+// ValidateSurveyHandler checks posted survey data (encrypted) without
+// submitting it. See dryRunSurvey.
+func ValidateSurveyHandler(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf(`event="Failed to read posted data" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Request body unreadable",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+	if len(body) == 0 {
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Request body empty",
+			Status: http.StatusBadRequest,
+		}, rw)
+		return
+	}
+	dryRunSurvey(r.Context(), rw, body)
+}
+
+// isDryRun reports whether a submission is only to be checked
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+// dryRunSurvey decrypts, parses and validates posted survey data exactly as
+// a real submission would be, but stops there - nothing is stored, published,
+// tracked or claimed. It answers with the same problem a submission would get,
+// or a 200 describing the valid survey.
+func dryRunSurvey(ctx context.Context, rw http.ResponseWriter, data []byte) {
+	survey, _, problem := parseSubmission(data)
+	if problem == nil {
+		problem = checkOrigin(ctx, survey)
+	}
+	if problem != nil {
+		api.WriteProblemResponse(*problem, rw)
+		return
+	}
+	log.Printf(`event="Survey passed dry run" tx_id="%s"`, survey.TxID)
+
+	body, err := json.Marshal(validationResult{
+		Valid:        true,
+		TxID:         survey.TxID,
+		SurveyID:     survey.SurveyID,
+		InstrumentID: survey.Collection.InstrumentID,
+	})
+	if err != nil {
+		log.Printf(`event="Failed to marshal validation result" error="%v"`, err)
+		api.WriteProblemResponse(api.Problem{
+			Title:  "Failed to build response",
+			Status: http.StatusInternalServerError,
+		}, rw)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// validateSurvey checks the survey JSON against the schema registered for
+// its survey_id and instrument_id. It returns nil if the survey is valid, or
+// has no schema and rejectUnknownSurveys is off, otherwise the problem to
+// report back to the client.
+func validateSurvey(survey Survey, body []byte) *api.Problem {
+	violations, err := schemas.Validate(survey.SurveyID, survey.Collection.InstrumentID, body)
+	if errors.Is(err, schema.ErrUnknownSchema) {
+		if !rejectUnknownSurveys {
+			log.Printf(`event="No schema for survey - passing through" tx_id="%s" survey_id="%s" instrument_id="%s"`, survey.TxID, survey.SurveyID, survey.Collection.InstrumentID)
+			return nil
+		}
+		return &api.Problem{
+			Title:  "Unknown survey",
+			Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("No schema for survey_id %q and instrument_id %q", survey.SurveyID, survey.Collection.InstrumentID),
+		}
+	}
+	if err != nil {
+		log.Printf(`event="Failed to validate survey" error="%v"`, err)
+		return &api.Problem{
+			Title:  "Failed to validate survey JSON",
+			Status: http.StatusBadRequest,
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	problem := &api.Problem{
+		Title:         "Survey JSON failed validation",
+		Status:        http.StatusBadRequest,
+		Detail:        fmt.Sprintf("%d element(s) did not match the schema for survey_id %q and instrument_id %q", len(violations), survey.SurveyID, survey.Collection.InstrumentID),
+		InvalidParams: make([]api.InvalidParam, 0, len(violations)),
+	}
+	for _, v := range violations {
+		problem.InvalidParams = append(problem.InvalidParams, api.InvalidParam{Name: v.Pointer, Reason: v.Reason})
+	}
+	return problem
+}
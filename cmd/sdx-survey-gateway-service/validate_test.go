@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/keyring"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/outbox"
+	"github.com/ONSdigital/sdx-evolution/cmd/sdx-survey-gateway-service/schema"
+	"github.com/ONSdigital/sdx-evolution/internal/redis"
+	"github.com/ONSdigital/sdx-evolution/internal/tracker"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// eqToken signs survey JSON and encrypts it for the eq-submission keys in
+// dir - a new key pair written there - as eQ would
+func eqToken(t *testing.T, dir string, survey []byte) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	os.MkdirAll(filepath.Join(dir, eqSubmissionPurpose), 0700)
+	ioutil.WriteFile(filepath.Join(dir, eqSubmissionPurpose, "test.private.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, eqSubmissionPurpose, "test.public.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0600)
+
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString([]byte(`{"alg":"RS256","kid":"test"}`)) + "." + enc.EncodeToString(survey)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws := input + "." + enc.EncodeToString(sig)
+
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	rand.Read(cek)
+	rand.Read(iv)
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &key.PublicKey, cek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	protected := enc.EncodeToString([]byte(`{"alg":"RSA-OAEP","enc":"A256GCM","kid":"test"}`))
+	sealed := gcm.Seal(nil, iv, []byte(jws), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+
+	return strings.Join([]string{
+		protected,
+		enc.EncodeToString(encryptedKey),
+		enc.EncodeToString(iv),
+		enc.EncodeToString(ciphertext),
+		enc.EncodeToString(tag),
+	}, ".")
+}
+
+func TestValidateSurveyUnknown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if schemas, err = schema.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { rejectUnknownSurveys = false }()
+
+	survey := Survey{TxID: "0f534ffc-9442-414c-b39f-a756b4adc6cb", SurveyID: "999"}
+	if problem := validateSurvey(survey, []byte(`{}`)); problem != nil {
+		t.Errorf("Expected a survey with no schema to pass through, got %+v", problem)
+	}
+
+	rejectUnknownSurveys = true
+	if problem := validateSurvey(survey, []byte(`{}`)); problem == nil || problem.Status != http.StatusBadRequest {
+		t.Errorf("Expected a survey with no schema to be rejected, got %+v", problem)
+	}
+}
+
+func TestPostedSurveyDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	token := eqToken(t, filepath.Join(dir, "keys"), []byte(`{"tx_id": "0f534ffc-9442-414c-b39f-a756b4adc6cb", "survey_id": "023", "collection": {"instrument_id": "0203"}}`))
+	if keys, err = keyring.Load(filepath.Join(dir, "keys")); err != nil {
+		t.Fatal(err)
+	}
+	if schemas, err = schema.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if notifyOutbox, err = outbox.Open(filepath.Join(dir, "outbox.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer notifyOutbox.Close()
+
+	// Claiming the tx_id or tracking it would need redis
+	dials := 0
+	redisPool = &redis.Pool{Dial: func() (redigo.Conn, error) {
+		dials++
+		return nil, errors.New("no redis")
+	}}
+	stages = tracker.New(redisPool, "sdx-survey-gateway-service")
+	defer func() { redisPool, stages = nil, nil }()
+
+	rw := httptest.NewRecorder()
+	PostedSurveyHandler(rw, httptest.NewRequest("POST", "/survey?dry_run=true", strings.NewReader(token)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a valid dry run, got %d %s", rw.Code, rw.Body)
+	}
+	if dials != 0 {
+		t.Errorf("Expected no claim or tracking for a dry run, got %d redis connections", dials)
+	}
+	if pending, _ := notifyOutbox.Pending(); len(pending) != 0 {
+		t.Errorf("Expected nothing to be published for a dry run, got %+v", pending)
+	}
+
+	// The same submission for real would claim its tx_id
+	rw = httptest.NewRecorder()
+	PostedSurveyHandler(rw, httptest.NewRequest("POST", "/survey", strings.NewReader(token)))
+	if rw.Code != http.StatusServiceUnavailable || dials == 0 {
+		t.Errorf("Expected a submission to try to claim its tx_id, got %d after %d redis connections", rw.Code, dials)
+	}
+}
@@ -6,4 +6,6 @@ require (
 	github.com/garyburd/redigo v1.6.0
 	github.com/gorilla/mux v1.7.3
 	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.etcd.io/bbolt v1.3.5
 )
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// Body returns middleware that reads a request body up front, answering with
+// a problem rather than calling the handler if:
+//   - its media type isn't one of contentTypes (415)
+//   - it has a Content-Encoding other than gzip or deflate (415)
+//   - it is larger than maxBytes, either as sent or once decoded (413)
+//
+// The handler gets the decoded body, with Content-Encoding removed, so it
+// can read it without worrying about any of this.
+func Body(maxBytes int64, contentTypes ...string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(contentTypes))
+	for _, t := range contentTypes {
+		allowed[t] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if !allowed[mediaType] {
+				WriteProblemResponse(Problem{
+					Title:  "Unsupported media type",
+					Status: http.StatusUnsupportedMediaType,
+					Detail: fmt.Sprintf("Content-Type must be one of: %s", strings.Join(contentTypes, ", ")),
+				}, rw)
+				return
+			}
+			if r.ContentLength > maxBytes {
+				writeTooLarge(rw, maxBytes)
+				return
+			}
+
+			var body io.Reader = &limitedReader{r: r.Body, n: maxBytes}
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			var err error
+			switch encoding {
+			case "", "identity":
+			case "gzip", "x-gzip":
+				body, err = gzip.NewReader(body)
+			case "deflate":
+				body, err = zlib.NewReader(body)
+			default:
+				WriteProblemResponse(Problem{
+					Title:  "Unsupported content encoding",
+					Status: http.StatusUnsupportedMediaType,
+					Detail: "Content-Encoding must be gzip or deflate if given",
+				}, rw)
+				return
+			}
+
+			// The decoded size is limited too, so a small compressed body
+			// can't expand to fill memory
+			var data []byte
+			if err == nil {
+				data, err = ioutil.ReadAll(&limitedReader{r: body, n: maxBytes})
+			}
+			if errors.Is(err, errBodyTooLarge) {
+				writeTooLarge(rw, maxBytes)
+				return
+			}
+			if err != nil {
+				log.Printf(`event="Failed to read request body" encoding="%s" error="%v"`, encoding, err)
+				WriteProblemResponse(Problem{
+					Title:  "Request body unreadable",
+					Status: http.StatusBadRequest,
+				}, rw)
+				return
+			}
+
+			r.Body = ioutil.NopCloser(bytes.NewReader(data))
+			r.ContentLength = int64(len(data))
+			r.Header.Del("Content-Encoding")
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func writeTooLarge(rw http.ResponseWriter, maxBytes int64) {
+	WriteProblemResponse(Problem{
+		Title:  "Request entity too large",
+		Status: http.StatusRequestEntityTooLarge,
+		Detail: fmt.Sprintf("The request body may be at most %d bytes", maxBytes),
+	}, rw)
+}
+
+// limitedReader reads from r, failing with errBodyTooLarge once more than n
+// bytes have been read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
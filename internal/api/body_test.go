@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if encoding == "gzip" {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w = zlib.NewWriter(&buf)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBody(t *testing.T) {
+	var got []byte
+	handler := Body(64, "application/json", "application/jose")(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got, _ = ioutil.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	for name, test := range map[string]struct {
+		contentType string
+		encoding    string
+		body        []byte
+		expected    int
+	}{
+		"plain":                {"application/json", "", []byte(`{"a":1}`), http.StatusOK},
+		"with charset":         {"application/json; charset=utf-8", "", []byte(`{"a":1}`), http.StatusOK},
+		"gzip":                 {"application/jose", "gzip", compress(t, "gzip", []byte("a.b.c.d.e")), http.StatusOK},
+		"deflate":              {"application/jose", "deflate", compress(t, "deflate", []byte("a.b.c.d.e")), http.StatusOK},
+		"too large":            {"application/json", "", []byte(strings.Repeat("a", 65)), http.StatusRequestEntityTooLarge},
+		"too large decoded":    {"application/json", "gzip", compress(t, "gzip", []byte(strings.Repeat("a", 1000))), http.StatusRequestEntityTooLarge},
+		"wrong type":           {"text/plain", "", []byte("a"), http.StatusUnsupportedMediaType},
+		"no type":              {"", "", []byte("a"), http.StatusUnsupportedMediaType},
+		"unsupported encoding": {"application/json", "br", []byte("a"), http.StatusUnsupportedMediaType},
+		"bad gzip":             {"application/json", "gzip", []byte("not gzip"), http.StatusBadRequest},
+	} {
+		got = nil
+		r := httptest.NewRequest("POST", "/survey", bytes.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		r.Header.Set("Content-Encoding", test.encoding)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+
+		if rw.Code != test.expected {
+			t.Errorf("Expected %d for %s, got %d", test.expected, name, rw.Code)
+		}
+		if test.expected == http.StatusOK && len(got) == 0 {
+			t.Errorf("Expected handler to get the decoded body for %s", name)
+		}
+		if test.expected != http.StatusOK && got != nil {
+			t.Errorf("Expected handler not to be called for %s", name)
+		}
+	}
+}
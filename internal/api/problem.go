@@ -12,6 +12,17 @@ type Problem struct {
 	Title  string `json:"title,omitempty"`  // Short description of the issue
 	Status int    `json:"status,omitempty"` // The http status code
 	Detail string `json:"detail,omitempty"` // Further human-readable detail
+
+	// InvalidParams is an extension member listing the individual parts of
+	// a request that failed validation (see the example in RFC7807 s3)
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
+}
+
+// InvalidParam describes a single invalid part of a request. For JSON bodies
+// Name is a JSON pointer (RFC6901) to the offending element.
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
 }
 
 // WriteProblemResponse writes an API problem response report to the given ResponseWriter.
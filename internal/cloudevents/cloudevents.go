@@ -0,0 +1,290 @@
+// Package cloudevents implements the CloudEvents (v1.0) AMQP protocol
+// binding, so that pipeline messages can be consumed with standard
+// CloudEvents tooling.
+//
+// Both content modes are supported:
+//   - binary: the event data is the message body, its content type is the
+//     message content type and every other attribute is an application
+//     header prefixed with "cloudEvents_"
+//   - structured: the whole event is the message body, encoded in the JSON
+//     event format with the content type application/cloudevents+json
+//
+// FromDelivery reads either, so a consumer doesn't need to know which mode
+// the publisher was configured with.
+package cloudevents
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// SpecVersion is the version of the CloudEvents spec implemented
+	SpecVersion = "1.0"
+
+	// StructuredContentType is the content type of a structured mode message
+	StructuredContentType = "application/cloudevents+json"
+
+	// headerPrefix is the prefix for attributes in binary mode. The spec
+	// also allows "cloudEvents:", which is accepted when reading.
+	headerPrefix    = "cloudEvents_"
+	altHeaderPrefix = "cloudEvents:"
+)
+
+// Mode is how an event is carried in an AMQP message
+type Mode string
+
+// The content modes of the AMQP binding
+const (
+	Binary     Mode = "binary"
+	Structured Mode = "structured"
+)
+
+var (
+	// ErrNotEvent is returned by FromDelivery for a message that isn't a
+	// CloudEvent in either mode
+	ErrNotEvent = errors.New("not a cloudevent")
+
+	// ErrMalformed is returned for an event that is missing a required
+	// attribute or can't be decoded
+	ErrMalformed = errors.New("malformed cloudevent")
+
+	// ErrUnsupportedVersion is returned for an event with a specversion
+	// other than 1.x
+	ErrUnsupportedVersion = errors.New("unsupported cloudevents specversion")
+)
+
+// ParseMode parses the name of a content mode, as used in config
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(s)); m {
+	case Binary, Structured:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown cloudevents mode %q - expected %q or %q", s, Binary, Structured)
+}
+
+// Event is a CloudEvent. ID, Source and Type are required.
+type Event struct {
+	ID              string
+	Source          string // URI-reference identifying the producer
+	Type            string // Reverse DNS style, e.g. uk.gov.ons.sdx.survey.notify
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	DataSchema      string
+	Data            []byte
+}
+
+// structuredEvent is the JSON event format
+type structuredEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// Publishing encodes the event as a persistent AMQP message in the given
+// mode. The message id and timestamp properties are set from the event id and
+// time.
+func (e Event) Publishing(mode Mode) (amqp.Publishing, error) {
+	if err := e.validate(); err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	msg := amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		MessageId:    e.ID,
+		Timestamp:    e.Time,
+	}
+
+	switch mode {
+	case Binary:
+		msg.ContentType = e.DataContentType
+		msg.Body = e.Data
+		msg.Headers = amqp.Table{
+			headerPrefix + "specversion": SpecVersion,
+			headerPrefix + "id":          e.ID,
+			headerPrefix + "source":      e.Source,
+			headerPrefix + "type":        e.Type,
+		}
+		if len(e.Subject) > 0 {
+			msg.Headers[headerPrefix+"subject"] = e.Subject
+		}
+		if !e.Time.IsZero() {
+			msg.Headers[headerPrefix+"time"] = e.Time.UTC().Format(time.RFC3339Nano)
+		}
+		if len(e.DataSchema) > 0 {
+			msg.Headers[headerPrefix+"dataschema"] = e.DataSchema
+		}
+
+	case Structured:
+		se := structuredEvent{
+			SpecVersion:     SpecVersion,
+			ID:              e.ID,
+			Source:          e.Source,
+			Type:            e.Type,
+			Subject:         e.Subject,
+			DataContentType: e.DataContentType,
+			DataSchema:      e.DataSchema,
+		}
+		if !e.Time.IsZero() {
+			se.Time = e.Time.UTC().Format(time.RFC3339Nano)
+		}
+		if len(e.Data) > 0 {
+			if isJSON(e.DataContentType) && json.Valid(e.Data) {
+				se.Data = e.Data
+			} else {
+				se.DataBase64 = base64.StdEncoding.EncodeToString(e.Data)
+			}
+		}
+		body, err := json.Marshal(&se)
+		if err != nil {
+			return amqp.Publishing{}, err
+		}
+		msg.ContentType = StructuredContentType
+		msg.Body = body
+
+	default:
+		return amqp.Publishing{}, fmt.Errorf("unknown cloudevents mode %q", mode)
+	}
+	return msg, nil
+}
+
+// IsEvent reports whether a message is a CloudEvent in either mode
+func IsEvent(d amqp.Delivery) bool {
+	if isStructured(d.ContentType) {
+		return true
+	}
+	_, ok := header(d.Headers, "specversion")
+	return ok
+}
+
+// FromDelivery decodes the event carried by a message, in either mode
+func FromDelivery(d amqp.Delivery) (*Event, error) {
+	if isStructured(d.ContentType) {
+		return fromStructured(d.Body)
+	}
+	if _, ok := header(d.Headers, "specversion"); ok {
+		return fromBinary(d)
+	}
+	return nil, ErrNotEvent
+}
+
+func fromBinary(d amqp.Delivery) (*Event, error) {
+	version, _ := header(d.Headers, "specversion")
+	if err := checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	e := &Event{DataContentType: d.ContentType, Data: d.Body}
+	e.ID, _ = header(d.Headers, "id")
+	e.Source, _ = header(d.Headers, "source")
+	e.Type, _ = header(d.Headers, "type")
+	e.Subject, _ = header(d.Headers, "subject")
+	e.DataSchema, _ = header(d.Headers, "dataschema")
+
+	// Normally a string, but the AMQP timestamp type is allowed too
+	for _, prefix := range []string{headerPrefix, altHeaderPrefix} {
+		switch t := d.Headers[prefix+"time"].(type) {
+		case time.Time:
+			e.Time = t
+		case string:
+			var err error
+			if e.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+				return nil, fmt.Errorf("%w: bad time: %v", ErrMalformed, err)
+			}
+		}
+	}
+	return e, e.validate()
+}
+
+func fromStructured(body []byte) (*Event, error) {
+	var se structuredEvent
+	if err := json.Unmarshal(body, &se); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if err := checkVersion(se.SpecVersion); err != nil {
+		return nil, err
+	}
+
+	e := &Event{
+		ID:              se.ID,
+		Source:          se.Source,
+		Type:            se.Type,
+		Subject:         se.Subject,
+		DataContentType: se.DataContentType,
+		DataSchema:      se.DataSchema,
+		Data:            []byte(se.Data),
+	}
+	if len(se.Time) > 0 {
+		var err error
+		if e.Time, err = time.Parse(time.RFC3339Nano, se.Time); err != nil {
+			return nil, fmt.Errorf("%w: bad time: %v", ErrMalformed, err)
+		}
+	}
+	if len(se.DataBase64) > 0 {
+		var err error
+		if e.Data, err = base64.StdEncoding.DecodeString(se.DataBase64); err != nil {
+			return nil, fmt.Errorf("%w: bad data_base64: %v", ErrMalformed, err)
+		}
+	}
+	if len(e.DataContentType) == 0 && len(se.Data) > 0 {
+		// The spec says data in the JSON format without a content type is
+		// JSON
+		e.DataContentType = "application/json"
+	}
+	return e, e.validate()
+}
+
+func (e Event) validate() error {
+	switch {
+	case len(e.ID) == 0:
+		return fmt.Errorf("%w: no id", ErrMalformed)
+	case len(e.Source) == 0:
+		return fmt.Errorf("%w: no source", ErrMalformed)
+	case len(e.Type) == 0:
+		return fmt.Errorf("%w: no type", ErrMalformed)
+	}
+	return nil
+}
+
+func checkVersion(v string) error {
+	if v != "1" && !strings.HasPrefix(v, "1.") {
+		return fmt.Errorf("%w: %q", ErrUnsupportedVersion, v)
+	}
+	return nil
+}
+
+// header gets a string attribute from the binary mode headers, under either
+// prefix
+func header(headers amqp.Table, name string) (string, bool) {
+	for _, prefix := range []string{headerPrefix, altHeaderPrefix} {
+		if v, ok := headers[prefix+name].(string); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func isStructured(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == StructuredContentType
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
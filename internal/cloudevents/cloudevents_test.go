@@ -0,0 +1,115 @@
+package cloudevents
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// deliver turns a publishing into the delivery a consumer would see
+func deliver(msg amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{
+		ContentType: msg.ContentType,
+		Headers:     msg.Headers,
+		MessageId:   msg.MessageId,
+		Timestamp:   msg.Timestamp,
+		Body:        msg.Body,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, data := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{"application/json", []byte(`{"tx_id":"abc"}`)},
+		{"text/plain", []byte("abc")},
+	} {
+		e := Event{
+			ID:              "abc",
+			Source:          "/sdx/survey-gateway",
+			Type:            "uk.gov.ons.sdx.survey.notify",
+			Subject:         "abc",
+			Time:            time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+			DataContentType: data.contentType,
+			Data:            data.data,
+		}
+
+		for _, mode := range []Mode{Binary, Structured} {
+			msg, err := e.Publishing(mode)
+			if err != nil {
+				t.Fatalf("Expected to encode %s event, got: %v", mode, err)
+			}
+			if mode == Structured && msg.ContentType != StructuredContentType {
+				t.Errorf("Expected structured content type, got: %s", msg.ContentType)
+			}
+
+			d := deliver(msg)
+			if !IsEvent(d) {
+				t.Errorf("Expected %s message to be recognised as an event", mode)
+			}
+			got, err := FromDelivery(d)
+			if err != nil {
+				t.Fatalf("Expected to decode %s event, got: %v", mode, err)
+			}
+			if got.ID != e.ID || got.Source != e.Source || got.Type != e.Type ||
+				got.Subject != e.Subject || !got.Time.Equal(e.Time) ||
+				got.DataContentType != e.DataContentType || !bytes.Equal(got.Data, e.Data) {
+				t.Errorf("Expected %s event %+v, got: %+v", mode, e, *got)
+			}
+		}
+	}
+}
+
+func TestFromDeliveryAltPrefix(t *testing.T) {
+	got, err := FromDelivery(amqp.Delivery{
+		ContentType: "application/json",
+		Headers: amqp.Table{
+			"cloudEvents:specversion": "1.0",
+			"cloudEvents:id":          "abc",
+			"cloudEvents:source":      "/sdx",
+			"cloudEvents:type":        "test",
+		},
+		Body: []byte(`{}`),
+	})
+	if err != nil {
+		t.Fatalf("Expected to decode event, got: %v", err)
+	}
+	if got.ID != "abc" {
+		t.Errorf("Expected id abc, got: %s", got.ID)
+	}
+}
+
+func TestFromDeliveryRejects(t *testing.T) {
+	for name, test := range map[string]struct {
+		d        amqp.Delivery
+		expected error
+	}{
+		"plain message": {
+			amqp.Delivery{ContentType: "application/json", Body: []byte(`{}`)},
+			ErrNotEvent,
+		},
+		"old specversion": {
+			amqp.Delivery{Headers: amqp.Table{"cloudEvents_specversion": "0.3"}},
+			ErrUnsupportedVersion,
+		},
+		"missing type": {
+			amqp.Delivery{
+				ContentType: StructuredContentType,
+				Body:        []byte(`{"specversion":"1.0","id":"abc","source":"/sdx"}`),
+			},
+			ErrMalformed,
+		},
+		"bad json": {
+			amqp.Delivery{ContentType: StructuredContentType, Body: []byte(`{`)},
+			ErrMalformed,
+		},
+	} {
+		if _, err := FromDelivery(test.d); !errors.Is(err, test.expected) {
+			t.Errorf("Expected %v for %s, got: %v", test.expected, name, err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package jose implements the small subset of JOSE (RFC7515 JWS and RFC7516
+// JWE, compact serialisation only) that is needed to receive survey data
+// from eQ.
+//
+// eQ signs the survey JSON with its own private key (JWS) and then encrypts
+// the resulting token with the SDX public key (JWE). Receiving services
+// therefore Decrypt first and then Verify the token that falls out.
+package jose
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	// Register the hash implementations used by the JWS algorithms
+	_ "crypto/sha512"
+)
+
+var (
+	// ErrMalformed is returned when a token can't be split or decoded into
+	// its constituent parts.
+	ErrMalformed = errors.New("malformed token")
+
+	// ErrUnsupportedAlgorithm is returned when a token header asks for an
+	// algorithm that we don't (or won't) support.
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+
+	// ErrDecryption is returned when a JWE token can't be decrypted with the
+	// supplied key.
+	ErrDecryption = errors.New("decryption failed")
+
+	// ErrSignature is returned when a JWS signature doesn't match the supplied
+	// key.
+	ErrSignature = errors.New("signature verification failed")
+)
+
+// Header holds the JOSE header fields we care about for either a JWE or JWS
+// token.
+type Header struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc,omitempty"`
+	KeyID       string `json:"kid,omitempty"`
+	Type        string `json:"typ,omitempty"`
+	ContentType string `json:"cty,omitempty"`
+	Zip         string `json:"zip,omitempty"`
+}
+
+// Key management algorithms for JWE mapped to the hash used by RSA-OAEP
+var oaepHashes = map[string]func() hash.Hash{
+	"RSA-OAEP":     sha1.New,
+	"RSA-OAEP-256": sha256.New,
+}
+
+// Content encryption algorithms for JWE mapped to their key size in bytes
+var contentKeySizes = map[string]int{
+	"A128GCM": 16,
+	"A192GCM": 24,
+	"A256GCM": 32,
+}
+
+// Signing algorithms for JWS mapped to their digest
+var signingHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// ParseHeader decodes the protected header of a compact JWE or JWS token
+// without otherwise validating the token. This is useful for finding the
+// key ID (kid) before attempting to Decrypt or Verify.
+func ParseHeader(token string) (*Header, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 && len(parts) != 5 {
+		return nil, fmt.Errorf("%w: expected 3 or 5 parts, got %d", ErrMalformed, len(parts))
+	}
+	return decodeHeader(parts[0])
+}
+
+// Decrypt decrypts a compact serialised JWE token using the given private key
+// and returns the plaintext along with the decoded header.
+func Decrypt(token string, key *rsa.PrivateKey) ([]byte, *Header, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 5 {
+		return nil, nil, fmt.Errorf("%w: JWE must have 5 parts, got %d", ErrMalformed, len(parts))
+	}
+
+	header, err := decodeHeader(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newHash, ok := oaepHashes[header.Algorithm]
+	if !ok {
+		return nil, header, fmt.Errorf("%w: alg %q", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+	keySize, ok := contentKeySizes[header.Encryption]
+	if !ok {
+		return nil, header, fmt.Errorf("%w: enc %q", ErrUnsupportedAlgorithm, header.Encryption)
+	}
+	if len(header.Zip) > 0 {
+		return nil, header, fmt.Errorf("%w: zip %q", ErrUnsupportedAlgorithm, header.Zip)
+	}
+
+	// parts[0] (the header) has already been decoded
+	decoded := make([][]byte, 5)
+	for i := 1; i < len(parts); i++ {
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(parts[i]); err != nil {
+			return nil, header, fmt.Errorf("%w: part %d: %v", ErrMalformed, i, err)
+		}
+	}
+	encryptedKey, iv, ciphertext, tag := decoded[1], decoded[2], decoded[3], decoded[4]
+
+	if key == nil {
+		return nil, header, fmt.Errorf("%w: no key supplied", ErrDecryption)
+	}
+
+	// Unwrap the content encryption key (CEK)
+	cek, err := rsa.DecryptOAEP(newHash(), nil, key, encryptedKey, nil)
+	if err != nil {
+		return nil, header, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	if len(cek) != keySize {
+		return nil, header, fmt.Errorf("%w: content key is %d bytes, expected %d", ErrDecryption, len(cek), keySize)
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, header, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, header, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return nil, header, fmt.Errorf("%w: bad iv or tag length", ErrMalformed)
+	}
+
+	// The additional authenticated data is the ASCII of the encoded header
+	// (RFC7516 section 5.2)
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, header, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+
+	return plaintext, header, nil
+}
+
+// Verify checks the signature of a compact serialised JWS token against the
+// given public key and, if valid, returns the payload along with the decoded
+// header.
+func Verify(token string, key *rsa.PublicKey) ([]byte, *Header, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("%w: JWS must have 3 parts, got %d", ErrMalformed, len(parts))
+	}
+
+	header, err := decodeHeader(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, ok := signingHashes[header.Algorithm]
+	if !ok {
+		// Importantly this also rejects "none"
+		return nil, header, fmt.Errorf("%w: alg %q", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, header, fmt.Errorf("%w: payload: %v", ErrMalformed, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, header, fmt.Errorf("%w: signature: %v", ErrMalformed, err)
+	}
+
+	if key == nil {
+		return nil, header, fmt.Errorf("%w: no key supplied", ErrSignature)
+	}
+
+	digest := h.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, h, digest.Sum(nil), signature); err != nil {
+		return nil, header, fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+
+	return payload, header, nil
+}
+
+func decodeHeader(encoded string) (*Header, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformed, err)
+	}
+	var header Header
+	if err = json.Unmarshal(raw, &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformed, err)
+	}
+	return &header, nil
+}
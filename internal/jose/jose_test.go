@@ -0,0 +1,112 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var enc = base64.RawURLEncoding
+
+// sign produces an RS256 JWS as eQ would
+func sign(t *testing.T, payload []byte, key *rsa.PrivateKey, header string) string {
+	input := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + enc.EncodeToString(sig)
+}
+
+// encrypt produces an RSA-OAEP/A256GCM JWE as eQ would
+func encrypt(t *testing.T, plaintext []byte, key *rsa.PublicKey, header string) string {
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	rand.Read(cek)
+	rand.Read(iv)
+
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, cek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+
+	protected := enc.EncodeToString([]byte(header))
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+
+	return strings.Join([]string{
+		protected,
+		enc.EncodeToString(encryptedKey),
+		enc.EncodeToString(iv),
+		enc.EncodeToString(ciphertext),
+		enc.EncodeToString(tag),
+	}, ".")
+}
+
+func TestDecryptAndVerify(t *testing.T) {
+	eqKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	sdxKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	payload := []byte(`{"tx_id":"0f534ffc-9442-414c-b39f-a756b4adc6cb"}`)
+	jws := sign(t, payload, eqKey, `{"alg":"RS256","kid":"eq-1"}`)
+	jwe := encrypt(t, []byte(jws), &sdxKey.PublicKey, `{"alg":"RSA-OAEP","enc":"A256GCM","kid":"sdx-1"}`)
+
+	h, err := ParseHeader(jwe)
+	if err != nil || h.KeyID != "sdx-1" {
+		t.Errorf("Expected to parse JWE header kid, got %v (%v)", h, err)
+	}
+
+	decrypted, _, err := Decrypt(jwe, sdxKey)
+	if err != nil {
+		t.Fatalf("Expected no error decrypting, got %v", err)
+	}
+
+	verified, header, err := Verify(string(decrypted), &eqKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Expected no error verifying, got %v", err)
+	}
+	if header.KeyID != "eq-1" {
+		t.Errorf("Expected kid eq-1, got %s", header.KeyID)
+	}
+	if string(verified) != string(payload) {
+		t.Errorf("Expected payload %s, got %s", payload, verified)
+	}
+
+	// Wrong keys
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, _, err = Decrypt(jwe, otherKey); !errors.Is(err, ErrDecryption) {
+		t.Errorf("Expected ErrDecryption with wrong key, got %v", err)
+	}
+	if _, _, err = Verify(jws, &otherKey.PublicKey); !errors.Is(err, ErrSignature) {
+		t.Errorf("Expected ErrSignature with wrong key, got %v", err)
+	}
+}
+
+func TestRejectsBadTokens(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	if _, _, err := Decrypt("not.a.token", key); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+
+	none := enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte("{}")) + "."
+	if _, _, err := Verify(none, &key.PublicKey); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("Expected alg none to be rejected, got %v", err)
+	}
+
+	jwe := encrypt(t, []byte("x"), &key.PublicKey, `{"alg":"RSA1_5","enc":"A256GCM"}`)
+	if _, _, err := Decrypt(jwe, key); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("Expected RSA1_5 to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Package notification defines the message published to the notify exchange
+// once a survey has been received and stored, so that consumers can learn
+// what the survey is without parsing routing keys.
+//
+// The body is versioned JSON. Additive changes keep the same version - a
+// consumer should ignore fields it doesn't know about.
+//
+// A notification can also be published as a CloudEvent (see
+// internal/cloudevents), with the JSON as the event data. FromDelivery reads
+// any of these forms.
+package notification
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/internal/cloudevents"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// Version is the version of the notification format written by this
+	// package, and the highest it can read
+	Version = 1
+
+	// ContentType is the content type of an encoded notification
+	ContentType = "application/json"
+)
+
+// CloudEvent types for notifications
+const (
+	// NotifyEventType is a survey that has been received and stored
+	// (survey.notify.*)
+	NotifyEventType = "uk.gov.ons.sdx.survey.notify"
+
+	// DownstreamEventType is a survey routed to a downstream
+	// (survey.downstream.*)
+	DownstreamEventType = "uk.gov.ons.sdx.survey.downstream"
+)
+
+var (
+	// ErrMalformed is returned when a body can't be decoded as a notification
+	ErrMalformed = errors.New("malformed notification")
+
+	// ErrUnsupportedVersion is returned for a notification written in a
+	// version this package doesn't understand
+	ErrUnsupportedVersion = errors.New("unsupported notification version")
+)
+
+// Notification tells consumers that a survey has been received and stored
+type Notification struct {
+	Version      int       `json:"version"`
+	TxID         string    `json:"tx_id"`
+	Source       string    `json:"source"` // Where the survey came from, e.g. eq
+	SurveyID     string    `json:"survey_id"`
+	InstrumentID string    `json:"instrument_id"`
+	Period       string    `json:"period,omitempty"`
+	ExerciseSID  string    `json:"exercise_sid,omitempty"`
+	ReceivedAt   time.Time `json:"received_at"`
+}
+
+// Publishing encodes the notification as a persistent AMQP message. The
+// tx_id is used as both the message and correlation id, so a notification
+// republished after a failure can be recognised as a duplicate.
+func (n Notification) Publishing() (amqp.Publishing, error) {
+	if len(n.TxID) == 0 {
+		return amqp.Publishing{}, fmt.Errorf("%w: no tx_id", ErrMalformed)
+	}
+	n.Version = Version
+
+	body, err := json.Marshal(&n)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{
+		ContentType:   ContentType,
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     n.TxID,
+		CorrelationId: n.TxID,
+		Timestamp:     time.Now().UTC(),
+		Body:          body,
+	}, nil
+}
+
+// CloudEvent encodes the notification as a persistent AMQP message carrying
+// a CloudEvent with the given id and type in the given mode. The subject is
+// the tx_id, which is also the correlation id, so every event about the same
+// submission can be linked.
+func (n Notification) CloudEvent(mode cloudevents.Mode, id, source, eventType string) (amqp.Publishing, error) {
+	if len(n.TxID) == 0 {
+		return amqp.Publishing{}, fmt.Errorf("%w: no tx_id", ErrMalformed)
+	}
+	n.Version = Version
+
+	data, err := json.Marshal(&n)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	msg, err := cloudevents.Event{
+		ID:              id,
+		Source:          source,
+		Type:            eventType,
+		Subject:         n.TxID,
+		Time:            time.Now().UTC(),
+		DataContentType: ContentType,
+		Data:            data,
+	}.Publishing(mode)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	msg.CorrelationId = n.TxID
+	return msg, nil
+}
+
+// FromDelivery reads a notification from a message, whether it is a
+// CloudEvent (in either mode) or a plain notification body.
+func FromDelivery(d amqp.Delivery) (*Notification, error) {
+	if !cloudevents.IsEvent(d) {
+		return Decode(d.Body)
+	}
+	e, err := cloudevents.FromDelivery(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return Decode(e.Data)
+}
+
+// Decode reads a notification from a message body.
+//
+// Messages published before this format was introduced have just the tx_id
+// as their body. These are still accepted (so messages sitting on a queue
+// during an upgrade aren't lost) and give a notification with only TxID set
+// and a Version of 0.
+func Decode(body []byte) (*Notification, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("%w: empty body", ErrMalformed)
+	}
+	if trimmed[0] != '{' {
+		return &Notification{TxID: string(trimmed)}, nil
+	}
+
+	var n Notification
+	if err := json.Unmarshal(trimmed, &n); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if n.Version < 1 || n.Version > Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, n.Version)
+	}
+	if len(n.TxID) == 0 {
+		return nil, fmt.Errorf("%w: no tx_id", ErrMalformed)
+	}
+	return &n, nil
+}
@@ -0,0 +1,93 @@
+package notification
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/sdx-evolution/internal/cloudevents"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRoundTrip(t *testing.T) {
+	n := Notification{
+		TxID:         "0f534ffc-9442-414c-b39f-a756b4adc6cb",
+		Source:       "eq",
+		SurveyID:     "023",
+		InstrumentID: "0203",
+		Period:       "201605",
+		ExerciseSID:  "hfjdskf",
+		ReceivedAt:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	msg, err := n.Publishing()
+	if err != nil {
+		t.Fatalf("Expected to encode notification, got: %v", err)
+	}
+	if msg.ContentType != ContentType || msg.MessageId != n.TxID || msg.CorrelationId != n.TxID {
+		t.Errorf("Expected properties to be set, got: %+v", msg)
+	}
+	if msg.Timestamp.IsZero() {
+		t.Error("Expected a timestamp")
+	}
+
+	got, err := Decode(msg.Body)
+	if err != nil {
+		t.Fatalf("Expected to decode notification, got: %v", err)
+	}
+	n.Version = Version
+	if *got != n {
+		t.Errorf("Expected %+v, got: %+v", n, *got)
+	}
+}
+
+func TestDecodeBareTxID(t *testing.T) {
+	got, err := Decode([]byte("0f534ffc-9442-414c-b39f-a756b4adc6cb"))
+	if err != nil {
+		t.Fatalf("Expected to decode a bare tx_id, got: %v", err)
+	}
+	if got.TxID != "0f534ffc-9442-414c-b39f-a756b4adc6cb" || got.Version != 0 {
+		t.Errorf("Expected only the tx_id, got: %+v", *got)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	for body, expected := range map[string]error{
+		``:                          ErrMalformed,
+		`{"version":1`:              ErrMalformed,
+		`{"version":1}`:             ErrMalformed,
+		`{"tx_id":"abc"}`:           ErrUnsupportedVersion,
+		`{"version":2,"tx_id":"a"}`: ErrUnsupportedVersion,
+	} {
+		if _, err := Decode([]byte(body)); !errors.Is(err, expected) {
+			t.Errorf("Expected %v for %q, got: %v", expected, body, err)
+		}
+	}
+}
+
+func TestCloudEventFromDelivery(t *testing.T) {
+	n := Notification{Version: Version, TxID: "abc", Source: "eq", SurveyID: "023", InstrumentID: "0203"}
+
+	for _, mode := range []cloudevents.Mode{cloudevents.Binary, cloudevents.Structured} {
+		msg, err := n.CloudEvent(mode, n.TxID, "/sdx/survey-gateway", NotifyEventType)
+		if err != nil {
+			t.Fatalf("Expected to encode %s event, got: %v", mode, err)
+		}
+		if msg.CorrelationId != n.TxID {
+			t.Errorf("Expected correlation id %s, got: %s", n.TxID, msg.CorrelationId)
+		}
+
+		got, err := FromDelivery(amqp.Delivery{
+			ContentType: msg.ContentType,
+			Headers:     msg.Headers,
+			Body:        msg.Body,
+		})
+		if err != nil {
+			t.Fatalf("Expected to decode %s event, got: %v", mode, err)
+		}
+		if *got != n {
+			t.Errorf("Expected %+v from %s event, got: %+v", n, mode, *got)
+		}
+	}
+}
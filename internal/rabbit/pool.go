@@ -0,0 +1,178 @@
+package rabbit
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublisherPool shares a fixed number of confirming publisher channels
+// between goroutines, rather than opening (and declaring exchanges on) a new
+// channel for every publish.
+//
+// A channel that the broker closes, or that is left in an unknown state by a
+// confirm timeout, is discarded and a fresh one opened in its place the next
+// time one is needed.
+type PublisherPool struct {
+	open    func() (channel, error)
+	timeout time.Duration
+
+	// tokens limits the number of channels open at once, idle holds the
+	// channels not currently in use
+	tokens chan struct{}
+	idle   chan *ConfirmingPublisher
+
+	mu       sync.Mutex
+	declared map[string]bool
+}
+
+// NewPublisherPool creates a pool of up to size publishing channels on the
+// given connection. Channels are opened lazily. Each publish waits up to
+// confirmTimeout for the broker to confirm.
+func NewPublisherPool(conn *amqp.Connection, size int, confirmTimeout time.Duration) (*PublisherPool, error) {
+	if conn == nil {
+		return nil, errors.New("No rabbit connection supplied")
+	}
+	if size < 1 {
+		return nil, errors.New("pool size must be at least 1")
+	}
+
+	open := func() (channel, error) {
+		ch, err := conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		return ch, nil
+	}
+	return newPublisherPool(open, size, confirmTimeout), nil
+}
+
+func newPublisherPool(open func() (channel, error), size int, confirmTimeout time.Duration) *PublisherPool {
+	p := &PublisherPool{
+		open:     open,
+		timeout:  confirmTimeout,
+		tokens:   make(chan struct{}, size),
+		idle:     make(chan *ConfirmingPublisher, size),
+		declared: make(map[string]bool),
+	}
+	for i := 0; i < size; i++ {
+		p.tokens <- struct{}{}
+	}
+	return p
+}
+
+// DeclareExchange declares the named exchange (with defaults) unless it has
+// already been declared through this pool.
+func (p *PublisherPool) DeclareExchange(exchange string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.declared[exchange] {
+		return nil
+	}
+
+	pub, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = declareExchange(exchange, pub.ch)
+	p.put(pub, err)
+	if err != nil {
+		return err
+	}
+
+	p.declared[exchange] = true
+	log.Printf(`event="Declared exchange" exchange="%s"`, exchange)
+	return nil
+}
+
+// Publish declares the exchange if needed then publishes the message on a
+// pooled channel, blocking until the broker confirms it (see
+// ConfirmingPublisher.Publish). It blocks while every channel is busy.
+func (p *PublisherPool) Publish(exchange, key string, msg amqp.Publishing) error {
+	if err := p.DeclareExchange(exchange); err != nil {
+		return err
+	}
+
+	pub, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = pub.Publish(exchange, key, msg)
+	p.put(pub, err)
+
+	if errors.Is(err, ErrPublisherClosed) {
+		// Most likely a channel error caused by the exchange having gone
+		// away - make sure it's declared again next time
+		p.mu.Lock()
+		delete(p.declared, exchange)
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// Close closes every idle channel in the pool
+func (p *PublisherPool) Close() {
+	for {
+		select {
+		case pub := <-p.idle:
+			pub.Close()
+		default:
+			return
+		}
+	}
+}
+
+// get takes an idle publisher from the pool, opening a new channel if there
+// isn't one. It blocks until a token is available.
+func (p *PublisherPool) get() (*ConfirmingPublisher, error) {
+	<-p.tokens
+
+	select {
+	case pub := <-p.idle:
+		if !pub.IsClosed() {
+			return pub, nil
+		}
+	default:
+	}
+
+	ch, err := p.open()
+	if err != nil {
+		p.tokens <- struct{}{}
+		return nil, err
+	}
+	pub, err := newConfirmingPublisher(ch, p.timeout)
+	if err != nil {
+		ch.Close()
+		p.tokens <- struct{}{}
+		return nil, err
+	}
+	return pub, nil
+}
+
+// put returns a publisher to the pool after use. If the use left the channel
+// closed or in an unknown state it is discarded instead.
+func (p *PublisherPool) put(pub *ConfirmingPublisher, err error) {
+	defer func() { p.tokens <- struct{}{} }()
+
+	switch {
+	case pub.IsClosed(),
+		errors.Is(err, ErrPublisherClosed),
+		errors.Is(err, ErrConfirmTimeout):
+		log.Printf(`event="Discarding publisher channel" error="%v"`, err)
+		pub.Close()
+		return
+	}
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		log.Printf(`event="Discarding publisher channel" error="%v"`, err)
+		pub.Close()
+		return
+	}
+
+	p.idle <- pub
+}
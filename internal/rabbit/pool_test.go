@@ -0,0 +1,71 @@
+package rabbit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeChannels opens fake channels for a pool, keeping every one opened
+type fakeChannels struct {
+	respond func(f *fakeChannel, tag uint64, msg amqp.Publishing)
+	opened  []*fakeChannel
+}
+
+func (fc *fakeChannels) open() (channel, error) {
+	f := &fakeChannel{respond: fc.respond}
+	fc.opened = append(fc.opened, f)
+	return f, nil
+}
+
+func TestPublisherPoolReusesChannels(t *testing.T) {
+	fc := &fakeChannels{respond: ack}
+	p := newPublisherPool(fc.open, 2, time.Second)
+
+	for i := 0; i < 3; i++ {
+		if err := p.Publish("exchange", "key", amqp.Publishing{}); err != nil {
+			t.Fatalf("Expected publish to succeed, got %v", err)
+		}
+	}
+	if len(fc.opened) != 1 {
+		t.Errorf("Expected one channel to be reused, got %d opened", len(fc.opened))
+	}
+	if declared := fc.opened[0].declared; len(declared) != 1 || declared[0] != "exchange" {
+		t.Errorf("Expected the exchange to be declared once, got %v", declared)
+	}
+}
+
+func TestPublisherPoolReplacesClosedChannels(t *testing.T) {
+	fc := &fakeChannels{respond: ack}
+	p := newPublisherPool(fc.open, 1, time.Second)
+
+	if err := p.Publish("exchange", "key", amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broker closes the channel, e.g. after a channel level error
+	fc.opened[0].Close()
+	if err := p.Publish("exchange", "key", amqp.Publishing{}); err != nil {
+		t.Fatalf("Expected publish to succeed on a new channel, got %v", err)
+	}
+	if len(fc.opened) != 2 {
+		t.Errorf("Expected the closed channel to be replaced, got %d opened", len(fc.opened))
+	}
+
+	// Closed while publishing - the error is returned, the channel discarded
+	// and the exchange declared again on the next one
+	fc.respond = func(f *fakeChannel, tag uint64, msg amqp.Publishing) { f.Close() }
+	fc.opened[1].respond = fc.respond
+	if err := p.Publish("exchange", "key", amqp.Publishing{}); !errors.Is(err, ErrPublisherClosed) {
+		t.Errorf("Expected ErrPublisherClosed, got %v", err)
+	}
+	fc.respond = ack
+	if err := p.Publish("exchange", "key", amqp.Publishing{}); err != nil {
+		t.Fatalf("Expected publish to succeed after the channel closed, got %v", err)
+	}
+	if len(fc.opened) != 3 || len(fc.opened[2].declared) != 1 {
+		t.Errorf("Expected a new channel with the exchange declared again, got %d opened", len(fc.opened))
+	}
+}
@@ -0,0 +1,166 @@
+package rabbit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrNacked is returned when the broker refuses responsibility for a
+	// published message.
+	ErrNacked = errors.New("message nacked by broker")
+
+	// ErrReturned is returned when a mandatory message could not be routed to
+	// any queue.
+	ErrReturned = errors.New("message returned as unroutable")
+
+	// ErrConfirmTimeout is returned when the broker does not confirm a
+	// message within the publisher's timeout. The message may or may not have
+	// been accepted.
+	ErrConfirmTimeout = errors.New("timed out waiting for publish confirm")
+
+	// ErrPublisherClosed is returned when the underlying channel has closed
+	ErrPublisherClosed = errors.New("publisher channel closed")
+)
+
+// channel is the part of an *amqp.Channel used for publishing
+type channel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// ConfirmingPublisher publishes messages on a channel in confirm mode and
+// waits for the broker to ack (or nack) each one. Messages are published
+// with the mandatory flag so unroutable messages are reported rather than
+// silently dropped.
+//
+// Publishes are serialised so that each confirm can be matched to its
+// message - it is safe to share a publisher between goroutines but only one
+// message will be in flight at a time.
+type ConfirmingPublisher struct {
+	ch      channel
+	timeout time.Duration
+
+	mu       sync.Mutex
+	tag      uint64 // delivery tag of the last message published
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   chan *amqp.Error
+}
+
+// NewConfirmingPublisher puts the given channel into confirm mode and wraps
+// it in a ConfirmingPublisher. The channel should not be used for publishing
+// by anything else afterwards.
+func NewConfirmingPublisher(ch *amqp.Channel, timeout time.Duration) (*ConfirmingPublisher, error) {
+	if ch == nil {
+		return nil, errors.New("No rabbit channel supplied")
+	}
+	return newConfirmingPublisher(ch, timeout)
+}
+
+func newConfirmingPublisher(ch channel, timeout time.Duration) (*ConfirmingPublisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to put channel into confirm mode: %v", err)
+	}
+
+	return &ConfirmingPublisher{
+		ch:      ch,
+		timeout: timeout,
+		// Buffered so that late confirms/returns for timed out messages
+		// don't block the connection before the next Publish drains them
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 64)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 64)),
+		closed:   ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+// Publish publishes a mandatory message and blocks until the broker confirms
+// it, returns it as unroutable, or the timeout expires. A nil error means the
+// broker has taken responsibility for the message.
+func (p *ConfirmingPublisher) Publish(exchange, key string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ch.Publish(exchange, key, true, false, msg); err != nil {
+		return err
+	}
+	p.tag++
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	returned := false
+	isOurs := func(r amqp.Return) bool {
+		// A late return for an earlier (timed out) message can't be told
+		// apart unless the caller sets a MessageId
+		return len(msg.MessageId) == 0 || r.MessageId == msg.MessageId
+	}
+
+	for {
+		select {
+		case r, ok := <-p.returns:
+			if !ok {
+				return ErrPublisherClosed
+			}
+			returned = returned || isOurs(r)
+		case c, ok := <-p.confirms:
+			if !ok {
+				return ErrPublisherClosed
+			}
+			if c.DeliveryTag < p.tag {
+				// Stale confirm for an earlier (timed out) message
+				continue
+			}
+			if !c.Ack {
+				return ErrNacked
+			}
+			// The broker sends basic.return before basic.ack for an unroutable
+			// mandatory message, so any return is already waiting for us
+		drain:
+			for {
+				select {
+				case r, ok := <-p.returns:
+					if !ok {
+						break drain
+					}
+					returned = returned || isOurs(r)
+				default:
+					break drain
+				}
+			}
+			if returned {
+				return fmt.Errorf("%w: exchange=%s key=%s", ErrReturned, exchange, key)
+			}
+			return nil
+		case <-p.closed:
+			return ErrPublisherClosed
+		case <-timer.C:
+			return ErrConfirmTimeout
+		}
+	}
+}
+
+// IsClosed reports whether the underlying channel has been closed, e.g. by
+// the broker following a channel level error
+func (p *ConfirmingPublisher) IsClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the underlying channel
+func (p *ConfirmingPublisher) Close() error {
+	return p.ch.Close()
+}
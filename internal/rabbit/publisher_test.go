@@ -0,0 +1,147 @@
+package rabbit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeChannel stands in for a broker channel. respond is called for each
+// message published, with its delivery tag, to send the broker's reply.
+type fakeChannel struct {
+	respond func(f *fakeChannel, tag uint64, msg amqp.Publishing)
+
+	mu        sync.Mutex
+	tag       uint64
+	declared  []string
+	confirms  chan amqp.Confirmation
+	returns   chan amqp.Return
+	closes    chan *amqp.Error
+	closeOnce sync.Once
+	isClosed  bool
+}
+
+func (f *fakeChannel) Confirm(noWait bool) error { return nil }
+
+func (f *fakeChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	f.confirms = c
+	return c
+}
+
+func (f *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	f.returns = c
+	return c
+}
+
+func (f *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	f.closes = c
+	return c
+}
+
+func (f *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.declared = append(f.declared, name)
+	return nil
+}
+
+func (f *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	f.mu.Lock()
+	if f.isClosed {
+		f.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	f.tag++
+	tag := f.tag
+	f.mu.Unlock()
+
+	if f.respond != nil {
+		f.respond(f, tag, msg)
+	}
+	return nil
+}
+
+// Close shuts the channel down as the library does - notifying then closing
+// every listener
+func (f *fakeChannel) Close() error {
+	f.closeOnce.Do(func() {
+		f.mu.Lock()
+		f.isClosed = true
+		f.mu.Unlock()
+		f.closes <- amqp.ErrClosed
+		close(f.closes)
+		close(f.confirms)
+		close(f.returns)
+	})
+	return nil
+}
+
+func ack(f *fakeChannel, tag uint64, msg amqp.Publishing) {
+	f.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+}
+
+func TestConfirmingPublisher(t *testing.T) {
+	for name, test := range map[string]struct {
+		respond  func(f *fakeChannel, tag uint64, msg amqp.Publishing)
+		expected error
+	}{
+		"ack": {ack, nil},
+		"nack": {func(f *fakeChannel, tag uint64, msg amqp.Publishing) {
+			f.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: false}
+		}, ErrNacked},
+		"return": {func(f *fakeChannel, tag uint64, msg amqp.Publishing) {
+			f.returns <- amqp.Return{MessageId: msg.MessageId}
+			ack(f, tag, msg)
+		}, ErrReturned},
+		"return for another message": {func(f *fakeChannel, tag uint64, msg amqp.Publishing) {
+			f.returns <- amqp.Return{MessageId: "earlier"}
+			ack(f, tag, msg)
+		}, nil},
+		"stale confirm": {func(f *fakeChannel, tag uint64, msg amqp.Publishing) {
+			f.confirms <- amqp.Confirmation{DeliveryTag: tag - 1, Ack: false}
+			ack(f, tag, msg)
+		}, nil},
+		"closed": {func(f *fakeChannel, tag uint64, msg amqp.Publishing) {
+			f.Close()
+		}, ErrPublisherClosed},
+		"no confirm": {nil, ErrConfirmTimeout},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := &fakeChannel{respond: test.respond}
+			p, err := newConfirmingPublisher(f, 50*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Something already published, so stale confirms have a tag
+			f.tag = 1
+			p.tag = 1
+
+			err = p.Publish("exchange", "key", amqp.Publishing{MessageId: "abc"})
+			if !errors.Is(err, test.expected) || (test.expected == nil && err != nil) {
+				t.Errorf("Expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestConfirmingPublisherClosed(t *testing.T) {
+	f := &fakeChannel{respond: ack}
+	p, err := newConfirmingPublisher(f, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.IsClosed() {
+		t.Error("Expected a new publisher to be open")
+	}
+
+	f.Close()
+	if !p.IsClosed() {
+		t.Error("Expected the publisher to be closed with its channel")
+	}
+	if err = p.Publish("exchange", "key", amqp.Publishing{}); err == nil {
+		t.Error("Expected publishing on a closed channel to fail")
+	}
+}
@@ -28,6 +28,10 @@ func ConnectWithRetry(uri string, retryInterval time.Duration) (conn *amqp.Conne
 // DeclareExchangeWithDefaults attempts to declare a given named exchange with
 // a set of default values.
 func DeclareExchangeWithDefaults(exchange string, ch *amqp.Channel) error {
+	return declareExchange(exchange, ch)
+}
+
+func declareExchange(exchange string, ch channel) error {
 	if err := ch.ExchangeDeclare(
 		exchange,
 		"topic",
@@ -68,6 +72,15 @@ func DeclareDeadLetterExchangeWithDefaults(exchange string, ch *amqp.Channel) (s
 // and exchange with a supplied processing function. If successful it returns
 // the context cancel function for the go routine it spawns.
 func StartSimpleTopicConsumer(exchange, topic, queueName string, conn *amqp.Connection, work func([]byte)) (func(), error) {
+	return StartTopicConsumer(exchange, topic, queueName, conn, func(d amqp.Delivery) {
+		work(d.Body)
+	})
+}
+
+// StartTopicConsumer is StartSimpleTopicConsumer for processing functions
+// that need the whole delivery (e.g. its properties and headers) rather than
+// just the body.
+func StartTopicConsumer(exchange, topic, queueName string, conn *amqp.Connection, work func(amqp.Delivery)) (func(), error) {
 	if conn == nil {
 		return nil, errors.New("No rabbit connection supplied")
 	}
@@ -105,7 +118,7 @@ func StartSimpleTopicConsumer(exchange, topic, queueName string, conn *amqp.Conn
 				log.Print(`event="Canceling consumer"`)
 				ch.Close()
 			default:
-				work(d.Body)
+				work(d)
 			}
 		}
 	}(ctx)
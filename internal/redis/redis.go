@@ -13,8 +13,28 @@ type (
 	// Conn is a proxied redigo connection so that client services don't have
 	// to also import redigo
 	Conn redis.Conn
+
+	// Pool is a proxied redigo connection pool. Unlike a single Conn it is
+	// safe to share between goroutines (e.g. HTTP handlers) - each should
+	// Get() a connection and Close() it when done.
+	Pool = redis.Pool
 )
 
+// ErrNil is returned when a key does not exist
+var ErrNil = redis.ErrNil
+
+// NewPool creates a connection pool for the redis instance at the given uri.
+// Connections are dialled lazily so this does not fail if redis is down.
+func NewPool(uri string, maxIdle int) *Pool {
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(uri)
+		},
+	}
+}
+
 // ConnectWithRetry will repeatedly try to connect to a redis instance at the
 // specified intervals
 func ConnectWithRetry(uri string, retryInterval time.Duration) (conn redis.Conn) {
@@ -39,6 +59,23 @@ func SetWithExpiry(key, value string, expiry int16, conn redis.Conn) error {
 	return nil
 }
 
+// SetWithTTL sets a simple key in redis with a TTL given as a duration, for
+// expiries that don't fit in SetWithExpiry
+func SetWithTTL(key, value string, ttl time.Duration, conn redis.Conn) error {
+	_, err := conn.Do("SET", key, value, "px", int64(ttl/time.Millisecond))
+	return err
+}
+
+// SetNXWithTTL sets a simple key in redis with a TTL only if the key does
+// not already exist. It returns true if the key was set.
+func SetNXWithTTL(key, value string, ttl time.Duration, conn redis.Conn) (bool, error) {
+	reply, err := conn.Do("SET", key, value, "px", int64(ttl/time.Millisecond), "nx")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
 // Set sets a simple key in redis (key does not set explict expiry)
 func Set(key, value string, conn redis.Conn) error {
 	_, err := conn.Do("SET", key, value)
@@ -56,3 +93,25 @@ func GetString(key string, conn redis.Conn) (string, error) {
 	}
 	return value, nil
 }
+
+// Delete removes a key from redis
+func Delete(key string, conn redis.Conn) error {
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+// PushWithTTL appends a value to the list at key and (re)sets the TTL of the
+// whole list, atomically.
+func PushWithTTL(key, value string, ttl time.Duration, conn redis.Conn) error {
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, value)
+	conn.Send("PEXPIRE", key, int64(ttl/time.Millisecond))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// GetList retrieves every value in the list at key, in order. A missing key
+// gives an empty list.
+func GetList(key string, conn redis.Conn) ([]string, error) {
+	return redis.Strings(conn.Do("LRANGE", key, 0, -1))
+}
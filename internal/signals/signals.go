@@ -36,3 +36,34 @@ func HandleFunc(handler func(os.Signal), sigsToHandle ...os.Signal) func() {
 
 	return cancel
 }
+
+// HandleEachFunc registers a handler to be run every time one of a given set of
+// signals is received by the process, e.g. to reload configuration on each
+// SIGHUP. The signals are no longer watched once cancelled.
+// It returns a cancel context function to allow termination of the go routine.
+func HandleEachFunc(handler func(os.Signal), sigsToHandle ...os.Signal) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Create a buffered channel that will capture the signals received
+	sigs := make(chan os.Signal, 1)
+
+	// Register to watch the requested signals
+	signal.Notify(sigs, sigsToHandle...)
+
+	go func(ctx context.Context) {
+		defer signal.Stop(sigs)
+
+		// Handle each signal until the context kills the watcher
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigs:
+				log.Printf(`event="Received signal" signal="%s"`, sig.String())
+				handler(sig)
+			}
+		}
+	}(ctx)
+
+	return cancel
+}
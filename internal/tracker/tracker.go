@@ -0,0 +1,116 @@
+// Package tracker records the progress of a submission through the SDX
+// pipeline, keyed by tx_id, so that any service can report where a survey
+// has got to without trawling logs across every container.
+//
+// Each service records the stages it is responsible for into a shared redis
+// list per tx_id. Tracking is best effort - a failure to record is logged
+// but never stops a survey being processed.
+package tracker
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	redis "github.com/ONSdigital/sdx-evolution/internal/redis"
+)
+
+// Stage is a step in the lifecycle of a submission
+type Stage string
+
+// Stages in the order a submission would normally pass through them
+const (
+	Received  Stage = "received"  // Accepted by the gateway
+	Stored    Stage = "stored"    // Written to the store service
+	Notified  Stage = "notified"  // Notification published by the gateway
+	Delayed   Stage = "delayed"   // Held back by the legacy router (may repeat)
+	Routed    Stage = "routed"    // Sent downstream by the legacy router
+	Delivered Stage = "delivered" // Picked up by a downstream adapter
+	Receipted Stage = "receipted" // Receipted (for now by the receipt sink)
+
+	// Failed means processing was given up on. Detail holds the reason.
+	Failed Stage = "failed"
+)
+
+const (
+	keyPrefix = "sdx_tracker:"
+
+	// TTL is how long the history of a submission is kept after its last
+	// recorded stage
+	TTL = time.Hour * 24 * 7
+)
+
+// Event is a single recorded stage transition
+type Event struct {
+	Stage   Stage     `json:"stage"`
+	At      time.Time `json:"at"`
+	Service string    `json:"service"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Status is the recorded history of a submission
+type Status struct {
+	TxID   string  `json:"tx_id"`
+	Stage  Stage   `json:"stage"` // The most recent stage
+	Events []Event `json:"stages"`
+}
+
+// Tracker records stages on behalf of a single service
+type Tracker struct {
+	pool    *redis.Pool
+	service string
+}
+
+// New creates a Tracker that records stages as the named service
+func New(pool *redis.Pool, service string) *Tracker {
+	return &Tracker{pool: pool, service: service}
+}
+
+// Record notes that the submission with the given tx_id has reached a stage.
+// Detail is optional free text (e.g. the downstream it was routed to).
+func (t *Tracker) Record(txID string, stage Stage, detail string) {
+	if t == nil || len(txID) == 0 {
+		return
+	}
+
+	event, err := json.Marshal(Event{
+		Stage:   stage,
+		At:      time.Now().UTC(),
+		Service: t.service,
+		Detail:  detail,
+	})
+	if err == nil {
+		conn := t.pool.Get()
+		defer conn.Close()
+		err = redis.PushWithTTL(keyPrefix+txID, string(event), TTL, conn)
+	}
+	if err != nil {
+		log.Printf(`event="Failed to record stage" tx_id="%s" stage="%s" error="%v"`, txID, stage, err)
+	}
+}
+
+// Status returns the recorded history of a submission, or nil if nothing has
+// been recorded for the tx_id.
+func (t *Tracker) Status(txID string) (*Status, error) {
+	conn := t.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.GetList(keyPrefix+txID, conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	status := &Status{TxID: txID, Events: make([]Event, 0, len(values))}
+	for _, v := range values {
+		var e Event
+		if err = json.Unmarshal([]byte(v), &e); err != nil {
+			return nil, err
+		}
+		status.Events = append(status.Events, e)
+	}
+	status.Stage = status.Events[len(status.Events)-1].Stage
+	return status, nil
+}
@@ -0,0 +1,115 @@
+package tracker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	redis "github.com/ONSdigital/sdx-evolution/internal/redis"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// fakeRedis keeps lists in memory, answering just the commands the tracker
+// uses
+type fakeRedis struct {
+	lists  map[string][]string
+	ttls   map[string]int64
+	queued [][]interface{}
+}
+
+func (f *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{Dial: func() (redigo.Conn, error) { return fakeConn{f}, nil }}
+}
+
+type fakeConn struct{ f *fakeRedis }
+
+func (c fakeConn) Close() error                  { return nil }
+func (c fakeConn) Err() error                    { return nil }
+func (c fakeConn) Flush() error                  { return nil }
+func (c fakeConn) Receive() (interface{}, error) { return nil, errors.New("not supported") }
+func (c fakeConn) Send(cmd string, args ...interface{}) error {
+	c.f.queued = append(c.f.queued, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (c fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "":
+		return nil, nil
+	case "EXEC":
+		for _, q := range c.f.queued {
+			switch q[0] {
+			case "RPUSH":
+				key := q[1].(string)
+				c.f.lists[key] = append(c.f.lists[key], q[2].(string))
+			case "PEXPIRE":
+				c.f.ttls[q[1].(string)] = q[2].(int64)
+			}
+		}
+		c.f.queued = nil
+		return []interface{}{}, nil
+	case "LRANGE":
+		var values []interface{}
+		for _, v := range c.f.lists[args[0].(string)] {
+			values = append(values, []byte(v))
+		}
+		return values, nil
+	}
+	return nil, errors.New("unexpected command " + cmd)
+}
+
+func TestTrackerStatus(t *testing.T) {
+	f := &fakeRedis{lists: map[string][]string{}, ttls: map[string]int64{}}
+	gateway := New(f.pool(), "gateway")
+	router := New(f.pool(), "router")
+
+	gateway.Record("abc", Received, "")
+	gateway.Record("abc", Stored, "")
+	router.Record("abc", Routed, "commonsoftware")
+	gateway.Record("def", Received, "")
+
+	status, err := gateway.Status("abc")
+	if err != nil {
+		t.Fatalf("Expected no error getting status, got %v", err)
+	}
+	if status.TxID != "abc" || status.Stage != Routed || len(status.Events) != 3 {
+		t.Fatalf("Expected 3 stages ending in routed, got %+v", status)
+	}
+	for i, expected := range []Event{
+		{Stage: Received, Service: "gateway"},
+		{Stage: Stored, Service: "gateway"},
+		{Stage: Routed, Service: "router", Detail: "commonsoftware"},
+	} {
+		e := status.Events[i]
+		if e.Stage != expected.Stage || e.Service != expected.Service || e.Detail != expected.Detail || e.At.IsZero() {
+			t.Errorf("Expected stage %d to be %+v, got %+v", i, expected, e)
+		}
+	}
+	if ttl := f.ttls[keyPrefix+"abc"]; ttl != int64(TTL/time.Millisecond) {
+		t.Errorf("Expected the history to be kept for %s, got %dms", TTL, ttl)
+	}
+
+	if status, err = gateway.Status("unknown"); err != nil || status != nil {
+		t.Errorf("Expected no status for an unknown tx_id, got %+v (%v)", status, err)
+	}
+}
+
+func TestTrackerRecordBestEffort(t *testing.T) {
+	// Nothing recorded without a tracker or a tx_id
+	var none *Tracker
+	none.Record("abc", Received, "")
+
+	f := &fakeRedis{lists: map[string][]string{}, ttls: map[string]int64{}}
+	New(f.pool(), "gateway").Record("", Received, "")
+	if len(f.lists) != 0 {
+		t.Errorf("Expected nothing recorded without a tx_id, got %v", f.lists)
+	}
+
+	// Redis being down is logged, not returned
+	down := New(&redis.Pool{Dial: func() (redigo.Conn, error) { return nil, errors.New("down") }}, "gateway")
+	down.Record("abc", Received, "")
+	if _, err := down.Status("abc"); err == nil {
+		t.Error("Expected an error getting status with redis down")
+	}
+}